@@ -9,9 +9,12 @@ import (
 	"fmt"
 	"logging"
 	"os"
+	"os/signal"
 	"scale"
 	"server"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -32,17 +35,57 @@ type Config struct {
 	UpperMB                int64             `yaml:"upper-mm"`
 	LowerGB                int64             `yaml:"lower-mg"`
 	UpperGB                int64             `yaml:"upper-mg"`
+	LowerIOMBps            float64           `yaml:"lower-io-mbps"`
+	UpperIOMBps            float64           `yaml:"upper-io-mbps"`
+	LowerIOPS              float64           `yaml:"lower-iops"`
+	UpperIOPS              float64           `yaml:"upper-iops"`
 	LowerConcReq           int64             `yaml:"lower-conc-req"`
 	UpperConcReq           int64             `yaml:"upper-conc-req"`
+	LowerRPS               int64             `yaml:"lower-rps"`
+	UpperRPS               int64             `yaml:"upper-rps"`
+	LatencyPercentile      float64           `yaml:"latency-percentile"`
+	LowerLatencyMs         float64           `yaml:"lower-latency-ms"`
+	UpperLatencyMs         float64           `yaml:"upper-latency-ms"`
 	ReqBufferLength        int64             `yaml:"req-buffer-length"` 
+	ConcReqKey             string            `yaml:"conc-req-key"`
+	Smoothing              cgroup_monitoring.SmoothingConfig `yaml:"smoothing"`
 	CollectionPeriod       string            `yaml:"collection-period"`
+	ScaleCooldown          string            `yaml:"scale-cooldown"`
+	ColdStartHold          string            `yaml:"cold-start-hold"`
+	CPUBPFPeriod           string            `yaml:"cpu-bpf-period"`
 	KeepAlive              string            `yaml:"keep-alive"`
-	Iface                  string            `yaml:"iface"`
+	Iface                  IfaceList         `yaml:"iface"`
+	AttachMode             string            `yaml:"attach-mode"`
+	ProxyPorts             []uint16          `yaml:"proxy-ports"`
 	Managers               map[string]string `yaml:"managers"`
 	Workers                map[string]string `yaml:"workers"`
 	Logging 		       map[string]bool   `yaml:"logging"`
 }
 
+// IfaceList is the iface setting, either a single name, a comma separated or
+// YAML list of names, or auto
+type IfaceList []string
+
+func (list *IfaceList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var names []string
+	if err := unmarshal(&names); err == nil {
+		*list = names
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*list = nil
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*list = append(*list, name)
+		}
+	}
+	return nil
+}
+
 func main() {
 
 	configPath := flag.String("config", "", "Path to the configuration file")
@@ -61,6 +104,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	scaleCooldown, err := time.ParseDuration(config.ScaleCooldown)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Failed to parse scale cooldown: %v", err))
+		os.Exit(1)
+	}
+
+	coldStartHold, err := time.ParseDuration(config.ColdStartHold)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Failed to parse cold start hold: %v", err))
+		os.Exit(1)
+	}
+
 	swarmNodeInfo, err := createswarmNodeInfo(config)
 	if err != nil {
 		logging.AddEventLog(fmt.Sprintf("Failed to create swarm node info: %v", err))
@@ -71,15 +126,42 @@ func main() {
 	memoryMonitoringEnabled := config.LowerMB >= 0 || config.UpperMB >= 0 || config.LowerGB >= 0 || config.UpperGB >= 0
 	cpuMonitoringEnabled := config.LowerCPU >= 0 || config.UpperCPU >= 0
 	concReqMonitoringEnabled := config.LowerConcReq >= 0 || config.UpperConcReq >= 0
-
-	if (cpuMonitoringEnabled && memoryMonitoringEnabled) || (memoryMonitoringEnabled && concReqMonitoringEnabled) || (cpuMonitoringEnabled && concReqMonitoringEnabled) {
-		logging.AddEventLog("More than one of CPU, memory or concurrent request monitoring are enabled. Please specific only one.")
+	ioMonitoringEnabled := config.LowerIOMBps >= 0 || config.UpperIOMBps >= 0 || config.LowerIOPS >= 0 || config.UpperIOPS >= 0
+	rpsMonitoringEnabled := config.LowerRPS >= 0 || config.UpperRPS >= 0
+	latencyMonitoringEnabled := config.LowerLatencyMs >= 0 || config.UpperLatencyMs >= 0
+
+	enabledCount := 0
+	for _, enabled := range []bool{cpuMonitoringEnabled, memoryMonitoringEnabled, concReqMonitoringEnabled, ioMonitoringEnabled, rpsMonitoringEnabled, latencyMonitoringEnabled} {
+		if enabled {
+			enabledCount++
+		}
+	}
+	if enabledCount > 1 {
+		logging.AddEventLog("More than one of CPU, memory, I/O, concurrent request, request rate or latency monitoring are enabled. Please specific only one.")
 		os.Exit(1)
 	}
 
 
+	if config.ConcReqKey != "netns" && config.ConcReqKey != "cgroup" {
+		logging.AddEventLog(fmt.Sprintf("Invalid conc-req-key %q, expected netns or cgroup", config.ConcReqKey))
+		os.Exit(1)
+	}
+	byCgroup := config.ConcReqKey == "cgroup"
+
 	if cpuMonitoringEnabled {
-		resource = &cgroup_monitoring.CPUResource{LowerUtil: config.LowerCPU, UpperUtil: config.UpperCPU}
+		cpuResource := &cgroup_monitoring.CPUResource{LowerUtil: config.LowerCPU, UpperUtil: config.UpperCPU, Smoothing: config.Smoothing}
+		if config.CPUBPFPeriod != "" {
+			bpfPeriod, err := time.ParseDuration(config.CPUBPFPeriod)
+			if err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to parse CPU BPF period: %v", err))
+				os.Exit(1)
+			}
+			if err := cpuResource.InitBPFSampling(bpfPeriod); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to setup sched_switch CPU sampling: %v", err))
+				os.Exit(1)
+			}
+		}
+		resource = cpuResource
 	} else if memoryMonitoringEnabled {
 		var lowerLimit, upperLimit int64
 		// Explicitly choose GB over MB if both are provided, instead of summing them
@@ -93,9 +175,11 @@ func main() {
 		} else {
 			upperLimit = config.UpperMB
 		}
-		resource = &cgroup_monitoring.MemoryResource{LowerLimit: lowerLimit, UpperLimit: upperLimit}
+		resource = &cgroup_monitoring.MemoryResource{LowerLimit: lowerLimit, UpperLimit: upperLimit, Smoothing: config.Smoothing}
+	} else if ioMonitoringEnabled {
+		resource = &cgroup_monitoring.IOResource{LowerMBps: config.LowerIOMBps, UpperMBps: config.UpperIOMBps, LowerIOPS: config.LowerIOPS, UpperIOPS: config.UpperIOPS, Smoothing: config.Smoothing}
 	} else if concReqMonitoringEnabled {
-		concreqresource := &conc_req_monitoring.ConcReqResource{LowerLimit: config.LowerConcReq, UpperLimit: config.UpperConcReq, BufferLength: config.ReqBufferLength}
+		concreqresource := &conc_req_monitoring.ConcReqResource{LowerLimit: config.LowerConcReq, UpperLimit: config.UpperConcReq, BufferLength: config.ReqBufferLength, Cooldown: scaleCooldown, ByCgroup: byCgroup}
 		// setup bpf listener
 		if err := conc_req_monitoring.InitBPFListener(*concreqresource); err != nil {
 			fmt.Printf(err.Error())
@@ -103,13 +187,29 @@ func main() {
 		}
 		
 		resource = concreqresource
+	} else if rpsMonitoringEnabled {
+		rpsResource := &conc_req_monitoring.ConcReqResource{LowerLimit: config.LowerRPS, UpperLimit: config.UpperRPS, BufferLength: config.ReqBufferLength, Metric: conc_req_monitoring.MetricRPS, Cooldown: scaleCooldown, ByCgroup: byCgroup}
+		if err := conc_req_monitoring.InitBPFListener(*rpsResource); err != nil {
+			fmt.Printf(err.Error())
+			os.Exit(1)
+		}
+
+		resource = rpsResource
+	} else if latencyMonitoringEnabled {
+		latencyResource := &conc_req_monitoring.LatencyResource{Percentile: config.LatencyPercentile, LowerMs: config.LowerLatencyMs, UpperMs: config.UpperLatencyMs, BufferLength: config.ReqBufferLength, Cooldown: scaleCooldown, ByCgroup: byCgroup}
+		if err := conc_req_monitoring.InitBPFListener(latencyResource.ListenerResource()); err != nil {
+			fmt.Printf(err.Error())
+			os.Exit(1)
+		}
+
+		resource = latencyResource
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	scaler := scale.GetScaler()
-	portListener, err := bpf_port_listen.GetBPFListener(config.Iface)
+	portListener, err := bpf_port_listen.GetBPFListener(bpf_port_listen.ListenerConfig{Ifaces: config.Iface, MaxHold: coldStartHold, AttachMode: config.AttachMode, ProxyPorts: config.ProxyPorts})
 	if err != nil {
 		logging.AddEventLog(fmt.Sprintf("Failed to setup BPF listener: %v", err))
 		os.Exit(1)
@@ -157,13 +257,15 @@ func main() {
 	// Start HTTP server for scaling requests if manager node
 	if swarmNodeInfo.AutoscalerManager {
 		go func() {
+			server.HandleMetrics(conc_req_monitoring.RecordConcurrency, conc_req_monitoring.ConcurrencySummary)
+			server.HandleReplicas(scale.GetServiceReplicas)
 			server.ScaleServer(scale.ChangeServiceReplicas)
 		}()
 	}
 
 	// Start server for port listener requests
 	go func() {
-		server.PortServer(portListener.ListenOnPort, portListener.RemovePort)
+		server.PortServer(portListener.ListenOnPort, portListener.RemovePort, portListener.ListenOnVIP, portListener.RemoveVIP, portListener.ListenOnHost, portListener.RemoveHost)
 	}()
 
 	if config.Logging["enable"] {
@@ -179,6 +281,10 @@ func main() {
 	// Wait for a signal to terminate
 	<-ctx.Done()
 
+	if closer, ok := resource.(interface{ Close() }); ok {
+		closer.Close()
+	}
+
 }
 
 func startMonitoring(parentCtx context.Context, containerID string, resource Resource, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
@@ -204,12 +310,26 @@ func loadConfig(path string) (*Config, error) {
 		UpperMB:               -1,
 		LowerGB:               -1,
 		UpperGB:               -1,
+		LowerIOMBps:           -1,
+		UpperIOMBps:           -1,
+		LowerIOPS:             -1,
+		UpperIOPS:             -1,
 		LowerConcReq:          -1,
 		UpperConcReq:          -1,
+		LowerRPS:              -1,
+		UpperRPS:              -1,
+		LatencyPercentile:     95,
+		LowerLatencyMs:        -1,
+		UpperLatencyMs:        -1,
 		ReqBufferLength:       5,
+		ConcReqKey:            "netns",
+		Smoothing:             cgroup_monitoring.SmoothingConfig{Method: "none", Alpha: 0.5, Window: 5, Breaches: 1},
 		KeepAlive:             "5s",
 		CollectionPeriod:      "10s",
-		Iface:                 "eth0",
+		ScaleCooldown:         "30s",
+		ColdStartHold:         "0s",
+		Iface:                 IfaceList{"eth0"},
+		AttachMode:            "tc",
 		Managers:              make(map[string]string),
 		Workers:               make(map[string]string),
 		Logging:               make(map[string]bool),
@@ -62,3 +62,7 @@ replace cgroup_monitoring => ../cgroup_monitoring
 require conc_req_monitoring v0.0.0
 
 replace conc_req_monitoring => ../conc_req_monitoring
+
+require bpf_events v0.0.0
+
+replace bpf_events => ../bpf_events
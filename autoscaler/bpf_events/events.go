@@ -0,0 +1,174 @@
+package bpf_events
+
+import (
+	"errors"
+	"fmt"
+	"logging"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// The BPF programs declare both transports and pick one with use_ringbuf:
+//
+//	events          BPF_MAP_TYPE_RINGBUF
+//	events_perf     BPF_MAP_TYPE_PERF_EVENT_ARRAY, sized at load time
+//	dropped_events  per-CPU count of events that couldn't be queued
+const (
+	ringbufMap = "events"
+	perfMap    = "events_perf"
+	droppedMap = "dropped_events"
+)
+
+// ErrClosed is returned by Read once the reader has been closed
+var ErrClosed = os.ErrClosed
+
+// How often lost event counts are checked and logged
+const lossCheckPeriod = 10 * time.Second
+
+// Configure chooses the transport before the collection is loaded. Ring
+// buffers need Linux 5.8, older kernels fall back to the perf event array.
+func Configure(spec *ebpf.CollectionSpec) (useRingbuf bool, err error) {
+	useRingbuf = features.HaveMapType(ebpf.RingBuf) == nil
+	if !useRingbuf {
+		// The kernel can't create the ring buffer at all, so load a placeholder.
+		// The verifier drops the code using it since use_ringbuf is constant.
+		spec.Maps[ringbufMap] = &ebpf.MapSpec{
+			Name:       ringbufMap,
+			Type:       ebpf.Array,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+		}
+	}
+
+	flag := uint32(0)
+	if useRingbuf {
+		flag = 1
+	}
+	if err := spec.RewriteConstants(map[string]interface{}{"use_ringbuf": flag}); err != nil {
+		return false, fmt.Errorf("setting event transport: %v", err)
+	}
+	return useRingbuf, nil
+}
+
+// Reader reads events from whichever transport Configure chose and keeps
+// count of the events lost on the way.
+type Reader struct {
+	name    string
+	ring    *ringbuf.Reader
+	perf    *perf.Reader
+	dropped *ebpf.Map
+
+	mu         sync.Mutex
+	perfLost   uint64
+	lastLogged uint64
+	closing    chan struct{}
+}
+
+// NewReader opens the events map of a loaded program. name identifies the
+// program in logs.
+func NewReader(name string, useRingbuf bool, events, eventsPerf, dropped *ebpf.Map) (*Reader, error) {
+	r := &Reader{name: name, dropped: dropped, closing: make(chan struct{})}
+
+	var err error
+	if useRingbuf {
+		r.ring, err = ringbuf.NewReader(events)
+	} else {
+		r.perf, err = perf.NewReader(eventsPerf, os.Getpagesize())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s event reader: %v", name, err)
+	}
+
+	transport := "perf event array"
+	if useRingbuf {
+		transport = "ring buffer"
+	}
+	logging.AddEventLog(fmt.Sprintf("Reading %s events from %s", name, transport))
+
+	go r.watchLosses()
+	return r, nil
+}
+
+// Read blocks until the next event arrives and returns its raw bytes
+func (r *Reader) Read() ([]byte, error) {
+	if r.ring != nil {
+		record, err := r.ring.Read()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+		return record.RawSample, nil
+	}
+
+	for {
+		record, err := r.perf.Read()
+		if err != nil {
+			if errors.Is(err, perf.ErrClosed) {
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+
+		if record.LostSamples > 0 {
+			r.mu.Lock()
+			r.perfLost += record.LostSamples
+			r.mu.Unlock()
+			continue
+		}
+		return record.RawSample, nil
+	}
+}
+
+// Lost returns the number of events lost so far, either dropped in the kernel
+// because the buffer was full or overwritten before they were read.
+func (r *Reader) Lost() uint64 {
+	r.mu.Lock()
+	lost := r.perfLost
+	r.mu.Unlock()
+
+	var perCPU []uint64
+	if err := r.dropped.Lookup(uint32(0), &perCPU); err == nil {
+		for _, dropped := range perCPU {
+			lost += dropped
+		}
+	}
+	return lost
+}
+
+func (r *Reader) Close() error {
+	close(r.closing)
+	if r.ring != nil {
+		return r.ring.Close()
+	}
+	return r.perf.Close()
+}
+
+// watchLosses logs whenever more events have been lost
+func (r *Reader) watchLosses() {
+	ticker := time.NewTicker(lossCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.closing:
+			return
+		case <-ticker.C:
+			lost := r.Lost()
+			if lost == r.lastLogged {
+				continue
+			}
+			logging.AddEventLog(fmt.Sprintf("Lost %d %s events (%d total)", lost-r.lastLogged, r.name, lost))
+			logging.AddBPFEventLossLog(r.name, lost)
+			r.lastLogged = lost
+		}
+	}
+}
@@ -0,0 +1,16 @@
+module bpf_events
+
+go 1.21.9
+
+require github.com/cilium/ebpf v0.15.0
+
+require logging v0.0.0
+
+require (
+	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
+
+replace logging => ../logging
@@ -2,68 +2,509 @@
 #include <bpf/bpf_helpers.h>
 #include <linux/pkt_cls.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/tcp.h>
+#include <linux/udp.h>
 #include <linux/if_ether.h>
 
 #ifndef IPPROTO_TCP
 #define IPPROTO_TCP 6
 #endif
 
-// Define u32 for convenience
+#ifndef IPPROTO_UDP
+#define IPPROTO_UDP 17
+#endif
+
+// IPv6 extension headers, linux/in6.h clashes with the libc headers
+#define NEXTHDR_HOP 0
+#define NEXTHDR_ROUTING 43
+#define NEXTHDR_FRAGMENT 44
+#define NEXTHDR_AUTH 51
+#define NEXTHDR_NONE 59
+#define NEXTHDR_DEST 60
+
+// Extension headers followed before giving up on finding the transport header
+#define MAX_IPV6_EXT_HEADERS 6
+
+// Define u32 and u64 for convenience
 typedef unsigned int u32;
+typedef unsigned long long u64;
+
+// A published port, also sent to user space when it sees traffic
+struct port_key {
+    __u16 port; // host byte order
+    __u8 protocol; // IPPROTO_TCP or IPPROTO_UDP
+    __u8 pad;
+};
+
+// An overlay network VIP, IPv4 addresses are IPv4-mapped
+struct vip_key {
+    __u8 addr[16];
+};
+
+// Sent to user space when a service should be woken. vip is all zeroes for
+// traffic to a published port. payload_len and payload_offset are set for a
+// proxy_event.
+struct wake_event {
+    struct port_key port;
+    struct vip_key vip;
+    __u32 payload_len;
+    __u32 payload_offset; // in the connection's byte stream
+};
+
+// A TCP connection to a proxy port, by its client
+struct flow_key {
+    __u8 saddr[16]; // IPv4 addresses are IPv4-mapped
+    __u16 sport; // host byte order
+    __u16 dport;
+};
+
+// Bytes of payload in one event, a full segment on Ethernet
+#define MAX_PAYLOAD 1460
+
+// Bytes at the start of each new proxy connection sent to user space. A
+// ClientHello with post-quantum key shares takes two segments, which GRO
+// may have merged into one packet, so a packet can take two events.
+#define PROXY_CHUNKS 2
+#define PROXY_BYTES (PROXY_CHUNKS * MAX_PAYLOAD)
+
+// Sent to user space with the start of a connection to a proxy port, which
+// finds the HTTP Host or TLS SNI in it. Only payload_len bytes of payload
+// are sent.
+struct proxy_event {
+    struct wake_event wake;
+    struct flow_key flow;
+    __u8 payload[MAX_PAYLOAD];
+};
+
+// Keep the event types in the BTF so bpf2go generates Go types for them
+const struct wake_event *unused_wake_event __attribute__((unused));
+const struct flow_key *unused_flow_key __attribute__((unused));
+
+// Set by the loader when a cold start hold time is configured. New TCP
+// connections to armed ports are then dropped at the SYN, so clients
+// retransmit until the first replica runs instead of being reset.
+volatile const u32 hold_connections = 0;
+
+// Cleared by the loader on kernels without bpf_xdp_load_bytes (5.18), the XDP
+// program then leaves proxy connections alone
+volatile const u32 xdp_proxy = 1;
 
-// Define the ports_map for monitoring specific TCP ports
+// Define the ports_map for monitoring specific ports
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, u32);
+    __type(key, struct port_key);
     __type(value, u32);
     __uint(max_entries, 256);
 } ports_map SEC(".maps");
 
-// Define the events map for signaling packet detection on monitored ports
+// Armed ports that have already woken their service. The first packet
+// inserts its port, which the hash map does atomically, so exactly one event
+// is sent per arming however many packets race in. Cleared when arming.
 struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __type(key, u32);
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct port_key);
+    __type(value, __u8);
+    __uint(max_entries, 256);
+} triggered_map SEC(".maps");
+
+// VIPs of scaled-to-zero services. Traffic between services goes to the
+// VIP, and when it has no backends IPVS drops it in the caller's namespace
+// before any interface sees it, so connects are caught at the socket.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct vip_key);
+    __type(value, u32);
+    __uint(max_entries, 256);
+} vips_map SEC(".maps");
+
+// VIPs that have already woken their service, like triggered_map
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct vip_key);
+    __type(value, __u8);
+    __uint(max_entries, 256);
+} triggered_vips_map SEC(".maps");
+
+// Ports of a reverse proxy shared by scaled-to-zero services, set by user
+// space while any of their hostnames is armed
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u16); // host byte order
     __type(value, u32);
-    __uint(max_entries, 8); // 8 CPUs, find the number of CPUs with `nproc`
+    __uint(max_entries, 16);
+} proxy_ports_map SEC(".maps");
+
+// New connections to proxy ports, with the sequence number of their first
+// byte. User space deletes a connection once it found its hostname.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct flow_key);
+    __type(value, __u32);
+    __uint(max_entries, 16384);
+} proxy_flows_map SEC(".maps");
+
+// Room to build a proxy_event, too large for the stack
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, u32);
+    __type(value, struct proxy_event);
+    __uint(max_entries, 1);
+} proxy_event_buf SEC(".maps");
+
+// Packets seen on each armed port, reset when arming
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct port_key);
+    __type(value, u64);
+    __uint(max_entries, 256);
+} port_hits_map SEC(".maps");
+
+// Define the events maps for signaling packet detection on monitored ports.
+// The ring buffer is used when the kernel supports it (5.8+), otherwise the
+// loader clears use_ringbuf and events go through the perf event array, which
+// is sized to the CPU count at load time.
+volatile const u32 use_ringbuf = 1;
+
+// Large enough for a burst of proxy events
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-SEC("classifier")
-int port_classifier(struct __sk_buff *skb) {
+struct {
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+    __uint(key_size, sizeof(u32));
+    __uint(value_size, sizeof(u32));
+} events_perf SEC(".maps");
 
-    void *data_end = (void *)(long)skb->data_end;
-    void *data = (void *)(long)skb->data;
+// Events that couldn't be queued because the buffer was full
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, u32);
+    __type(value, u64);
+    __uint(max_entries, 1);
+} dropped_events SEC(".maps");
+
+static __always_inline void emit_event(void *ctx, void *data, u64 size) {
+    long err;
+    if (use_ringbuf) {
+        err = bpf_ringbuf_output(&events, data, size, 0);
+    } else {
+        err = bpf_perf_event_output(ctx, &events_perf, BPF_F_CURRENT_CPU, data, size);
+    }
+
+    if (err) {
+        u32 key = 0;
+        u64 *dropped = bpf_map_lookup_elem(&dropped_events, &key);
+        if (dropped) {
+            (*dropped)++;
+        }
+    }
+}
+
+struct ipv6_frag_hdr {
+    __u8 nexthdr;
+    __u8 reserved;
+    __be16 frag_off;
+    __be32 identification;
+};
+
+// skip_ipv6_ext_headers follows the next header chain from *cursor and
+// returns the transport protocol, leaving *cursor at its header. Returns
+// NEXTHDR_NONE if the chain is too long, truncated, or the packet is a
+// non-first fragment without a transport header.
+static __always_inline __u8 skip_ipv6_ext_headers(void **cursor, void *data_end, __u8 nexthdr) {
+    #pragma unroll
+    for (int i = 0; i < MAX_IPV6_EXT_HEADERS; i++) {
+        switch (nexthdr) {
+        case NEXTHDR_HOP:
+        case NEXTHDR_ROUTING:
+        case NEXTHDR_DEST: {
+            struct ipv6_opt_hdr *opt = *cursor;
+            if ((void *)(opt + 1) > data_end) {
+                return NEXTHDR_NONE;
+            }
+            nexthdr = opt->nexthdr;
+            *cursor += (opt->hdrlen + 1) * 8; // in 8-octet units, not counting the first
+            break;
+        }
+        case NEXTHDR_AUTH: {
+            struct ipv6_opt_hdr *auth = *cursor;
+            if ((void *)(auth + 1) > data_end) {
+                return NEXTHDR_NONE;
+            }
+            nexthdr = auth->nexthdr;
+            *cursor += (auth->hdrlen + 2) * 4; // in 4-octet units, not counting the first two
+            break;
+        }
+        case NEXTHDR_FRAGMENT: {
+            struct ipv6_frag_hdr *frag = *cursor;
+            if ((void *)(frag + 1) > data_end) {
+                return NEXTHDR_NONE;
+            }
+            if (frag->frag_off & __constant_htons(0xFFF8)) {
+                return NEXTHDR_NONE; // only the first fragment has the transport header
+            }
+            nexthdr = frag->nexthdr;
+            *cursor += sizeof(*frag);
+            break;
+        }
+        default:
+            return nexthdr;
+        }
+    }
+    return NEXTHDR_NONE;
+}
+
+// A TCP or UDP packet to a port, with the TCP fields the proxy ports need
+struct packet_info {
+    struct port_key key;
+    struct flow_key flow;
+    int syn; // a TCP segment opening a connection
+    __u32 seq;
+    __u32 payload_off; // from the start of the packet
+};
 
+// parse_packet fills info from a TCP or UDP packet over IPv4 or IPv6.
+// Returns 0 for anything else.
+static __always_inline int parse_packet(void *data, void *data_end, struct packet_info *info) {
     struct ethhdr *eth = data;
     if ((void *)(eth + 1) > data_end) {
-        return TC_ACT_OK;
+        return 0;
+    }
+
+    void *cursor = eth + 1;
+    __u8 protocol;
+
+    if (eth->h_proto == __constant_htons(ETH_P_IP)) {
+        struct iphdr *ip = cursor;
+        if ((void *)(ip + 1) > data_end) {
+            return 0;
+        }
+        if (ip->frag_off & __constant_htons(0x1FFF)) {
+            return 0; // only the first fragment has the transport header
+        }
+        protocol = ip->protocol;
+        info->flow.saddr[10] = 0xff;
+        info->flow.saddr[11] = 0xff;
+        __builtin_memcpy(&info->flow.saddr[12], &ip->saddr, 4);
+        cursor += ip->ihl * 4;
+    } else if (eth->h_proto == __constant_htons(ETH_P_IPV6)) {
+        struct ipv6hdr *ip6 = cursor;
+        if ((void *)(ip6 + 1) > data_end) {
+            return 0;
+        }
+        __builtin_memcpy(info->flow.saddr, &ip6->saddr, 16);
+        cursor = ip6 + 1;
+        protocol = skip_ipv6_ext_headers(&cursor, data_end, ip6->nexthdr);
+    } else {
+        return 0;
+    }
+
+    if (protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = cursor;
+        if ((void *)(tcp + 1) > data_end) {
+            return 0;
+        }
+        info->key.port = __builtin_bswap16(tcp->dest); // Convert network byte order to host byte order
+        info->syn = tcp->syn && !tcp->ack;
+        info->seq = __builtin_bswap32(tcp->seq);
+        info->flow.sport = __builtin_bswap16(tcp->source);
+        info->flow.dport = info->key.port;
+        info->payload_off = (cursor - data) + tcp->doff * 4;
+    } else if (protocol == IPPROTO_UDP) {
+        struct udphdr *udp = cursor;
+        if ((void *)(udp + 1) > data_end) {
+            return 0;
+        }
+        info->key.port = __builtin_bswap16(udp->dest);
+    } else {
+        return 0;
+    }
+
+    info->key.protocol = protocol;
+    return 1;
+}
+
+// handle_proxy_packet sends the first PROXY_BYTES of each new connection to
+// a proxy port to user space, which wakes the service by its hostname. Each
+// event is tagged with its offset in the stream, so user space can put the
+// start of the connection back together.
+static __always_inline void handle_proxy_packet(void *ctx, int xdp, struct packet_info *info, __u32 pkt_len) {
+    if (info->syn) {
+        __u32 start = info->seq + 1; // the SYN takes one sequence number
+        bpf_map_update_elem(&proxy_flows_map, &info->flow, &start, BPF_ANY);
+        return;
+    }
+    if (info->payload_off >= pkt_len) {
+        return; // no data, e.g. the handshake ACK
+    }
+
+    __u32 *start = bpf_map_lookup_elem(&proxy_flows_map, &info->flow);
+    if (!start) {
+        return; // not a new connection, or its hostname was found
+    }
+    __u32 offset = info->seq - *start;
+    if (offset >= PROXY_BYTES) {
+        bpf_map_delete_elem(&proxy_flows_map, &info->flow);
+        return;
+    }
+
+    u32 zero = 0;
+    struct proxy_event *event = bpf_map_lookup_elem(&proxy_event_buf, &zero);
+    if (!event) {
+        return;
+    }
+
+    __u32 payload_off = info->payload_off;
+    #pragma unroll
+    for (int i = 0; i < PROXY_CHUNKS; i++) {
+        __s64 len = (__s64)pkt_len - payload_off;
+        if (len > (__s64)PROXY_BYTES - offset) {
+            len = (__s64)PROXY_BYTES - offset;
+        }
+        if (len <= 0) {
+            break;
+        }
+        if (len > MAX_PAYLOAD) {
+            len = MAX_PAYLOAD;
+        }
+
+        // Read through the helpers, the payload may be outside the linear
+        // data of the skb
+        long err;
+        if (xdp) {
+            err = bpf_xdp_load_bytes(ctx, payload_off, event->payload, len);
+        } else {
+            err = bpf_skb_load_bytes(ctx, payload_off, event->payload, len);
+        }
+        if (err) {
+            break;
+        }
+
+        __builtin_memset(&event->wake, 0, sizeof(event->wake));
+        event->wake.port.port = info->flow.dport;
+        event->wake.port.protocol = IPPROTO_TCP;
+        event->wake.payload_len = len;
+        event->wake.payload_offset = offset;
+        event->flow = info->flow;
+        emit_event(ctx, event, __builtin_offsetof(struct proxy_event, payload) + len);
+
+        payload_off += len;
+        offset += len;
     }
-    if (eth->h_proto != __constant_htons(ETH_P_IP)) {
-        return TC_ACT_OK;
+    if (offset >= PROXY_BYTES) {
+        bpf_map_delete_elem(&proxy_flows_map, &info->flow);
     }
+}
 
-    struct iphdr *ip = data + sizeof(*eth);
-    if ((void *)(ip + 1) > data_end) {
-        return TC_ACT_OK;
+// handle_packet does the work shared by the TC and XDP programs and returns
+// 1 if the packet should be dropped. pkt_len includes data outside the
+// linear area.
+static __always_inline int handle_packet(void *ctx, int xdp, void *data, void *data_end, __u32 pkt_len) {
+    struct packet_info info = {};
+    if (!parse_packet(data, data_end, &info)) {
+        return 0;
     }
-    if (ip->protocol != IPPROTO_TCP) {
-        return TC_ACT_OK;
+    struct port_key key = info.key;
+
+    u32 *found = bpf_map_lookup_elem(&ports_map, &key);
+    if (!found) {
+        if (key.protocol == IPPROTO_TCP && (!xdp || xdp_proxy) && bpf_map_lookup_elem(&proxy_ports_map, &key.port)) {
+            handle_proxy_packet(ctx, xdp, &info, pkt_len);
+        }
+        return 0;
     }
 
-    struct tcphdr *tcp = (void *)ip + sizeof(*ip);
-    if ((void *)(tcp + 1) > data_end) {
-        return TC_ACT_OK;
+    u64 *hits = bpf_map_lookup_elem(&port_hits_map, &key);
+    if (hits) {
+        __sync_fetch_and_add(hits, 1);
     }
 
-    u32 tcp_dest_port = __builtin_bswap16(tcp->dest); // Convert network byte order to host byte order
-    u32 *found = bpf_map_lookup_elem(&ports_map, &tcp_dest_port);
-    if (found) {
-        long value = tcp_dest_port; // Pass the detected port as the value
-        bpf_perf_event_output(skb, &events, BPF_F_CURRENT_CPU, &value, sizeof(value));
+    __u8 triggered = 1;
+    if (bpf_map_update_elem(&triggered_map, &key, &triggered, BPF_NOEXIST) == 0) {
+        struct wake_event event = {};
+        event.port = key; // Pass the detected port as the event
+        emit_event(ctx, &event, sizeof(event));
         //bpf_printk("Sent perf to scale to 1");
     }
 
-    return TC_ACT_OK;
+    return hold_connections && info.syn;
+}
+
+SEC("classifier")
+int port_classifier(struct __sk_buff *skb) {
+
+    void *data_end = (void *)(long)skb->data_end;
+    void *data = (void *)(long)skb->data;
+
+    return handle_packet(skb, 0, data, data_end, skb->len) ? TC_ACT_SHOT : TC_ACT_OK;
+}
+
+// Same classifier run earlier, before an skb is allocated
+SEC("xdp")
+int port_xdp(struct xdp_md *ctx) {
+    void *data_end = (void *)(long)ctx->data_end;
+    void *data = (void *)(long)ctx->data;
+
+    return handle_packet(ctx, 1, data, data_end, data_end - data) ? XDP_DROP : XDP_PASS;
+}
+
+// Fields of the sock/inet_sock_set_state tracepoint, see
+// /sys/kernel/tracing/events/sock/inet_sock_set_state/format
+struct inet_sock_set_state_args {
+    u64 common;
+    const void *skaddr;
+    int oldstate;
+    int newstate;
+    __u16 sport;
+    __u16 dport;
+    __u16 family;
+    __u16 protocol;
+    __u8 saddr[4];
+    __u8 daddr[4];
+    __u8 saddr_v6[16];
+    __u8 daddr_v6[16];
+};
+
+#define TCP_SYN_SENT 2
+#define TCP_CLOSE 7
+
+#ifndef AF_INET
+#define AF_INET 2
+#endif
+
+// Wakes services when something on this node connects to their VIP
+SEC("tracepoint/sock/inet_sock_set_state")
+int vip_connect(struct inet_sock_set_state_args *ctx) {
+    if (ctx->protocol != IPPROTO_TCP || ctx->oldstate != TCP_CLOSE || ctx->newstate != TCP_SYN_SENT) {
+        return 0;
+    }
+
+    struct vip_key vip = {};
+    if (ctx->family == AF_INET) {
+        vip.addr[10] = 0xff;
+        vip.addr[11] = 0xff;
+        __builtin_memcpy(&vip.addr[12], ctx->daddr, 4);
+    } else {
+        __builtin_memcpy(vip.addr, ctx->daddr_v6, 16);
+    }
+
+    if (!bpf_map_lookup_elem(&vips_map, &vip)) {
+        return 0;
+    }
+
+    __u8 triggered = 1;
+    if (bpf_map_update_elem(&triggered_vips_map, &vip, &triggered, BPF_NOEXIST) == 0) {
+        struct wake_event event = {};
+        event.port.port = ctx->dport;
+        event.port.protocol = IPPROTO_TCP;
+        event.vip = vip;
+        emit_event(ctx, &event, sizeof(event));
+    }
+
+    return 0;
 }
 
 char _license[] SEC("license") = "GPL";
@@ -12,6 +12,33 @@ import (
 	"github.com/cilium/ebpf"
 )
 
+type BPFFlowKey struct {
+	Saddr [16]uint8
+	Sport uint16
+	Dport uint16
+}
+
+type BPFPortKey struct {
+	Port     uint16
+	Protocol uint8
+	Pad      uint8
+}
+
+type BPFProxyEvent struct {
+	Wake    BPFWakeEvent
+	Flow    BPFFlowKey
+	Payload [1460]uint8
+}
+
+type BPFVipKey struct{ Addr [16]uint8 }
+
+type BPFWakeEvent struct {
+	Port          BPFPortKey
+	Vip           BPFVipKey
+	PayloadLen    uint32
+	PayloadOffset uint32
+}
+
 // LoadBPF returns the embedded CollectionSpec for BPF.
 func LoadBPF() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BPFBytes)
@@ -54,14 +81,25 @@ type BPFSpecs struct {
 // It can be passed ebpf.CollectionSpec.Assign.
 type BPFProgramSpecs struct {
 	PortClassifier *ebpf.ProgramSpec `ebpf:"port_classifier"`
+	PortXdp        *ebpf.ProgramSpec `ebpf:"port_xdp"`
+	VipConnect     *ebpf.ProgramSpec `ebpf:"vip_connect"`
 }
 
 // BPFMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type BPFMapSpecs struct {
-	Events   *ebpf.MapSpec `ebpf:"events"`
-	PortsMap *ebpf.MapSpec `ebpf:"ports_map"`
+	DroppedEvents    *ebpf.MapSpec `ebpf:"dropped_events"`
+	Events           *ebpf.MapSpec `ebpf:"events"`
+	EventsPerf       *ebpf.MapSpec `ebpf:"events_perf"`
+	PortHitsMap      *ebpf.MapSpec `ebpf:"port_hits_map"`
+	PortsMap         *ebpf.MapSpec `ebpf:"ports_map"`
+	ProxyEventBuf    *ebpf.MapSpec `ebpf:"proxy_event_buf"`
+	ProxyFlowsMap    *ebpf.MapSpec `ebpf:"proxy_flows_map"`
+	ProxyPortsMap    *ebpf.MapSpec `ebpf:"proxy_ports_map"`
+	TriggeredMap     *ebpf.MapSpec `ebpf:"triggered_map"`
+	TriggeredVipsMap *ebpf.MapSpec `ebpf:"triggered_vips_map"`
+	VipsMap          *ebpf.MapSpec `ebpf:"vips_map"`
 }
 
 // BPFObjects contains all objects after they have been loaded into the kernel.
@@ -83,14 +121,32 @@ func (o *BPFObjects) Close() error {
 //
 // It can be passed to LoadBPFObjects or ebpf.CollectionSpec.LoadAndAssign.
 type BPFMaps struct {
-	Events   *ebpf.Map `ebpf:"events"`
-	PortsMap *ebpf.Map `ebpf:"ports_map"`
+	DroppedEvents    *ebpf.Map `ebpf:"dropped_events"`
+	Events           *ebpf.Map `ebpf:"events"`
+	EventsPerf       *ebpf.Map `ebpf:"events_perf"`
+	PortHitsMap      *ebpf.Map `ebpf:"port_hits_map"`
+	PortsMap         *ebpf.Map `ebpf:"ports_map"`
+	ProxyEventBuf    *ebpf.Map `ebpf:"proxy_event_buf"`
+	ProxyFlowsMap    *ebpf.Map `ebpf:"proxy_flows_map"`
+	ProxyPortsMap    *ebpf.Map `ebpf:"proxy_ports_map"`
+	TriggeredMap     *ebpf.Map `ebpf:"triggered_map"`
+	TriggeredVipsMap *ebpf.Map `ebpf:"triggered_vips_map"`
+	VipsMap          *ebpf.Map `ebpf:"vips_map"`
 }
 
 func (m *BPFMaps) Close() error {
 	return _BPFClose(
+		m.DroppedEvents,
 		m.Events,
+		m.EventsPerf,
+		m.PortHitsMap,
 		m.PortsMap,
+		m.ProxyEventBuf,
+		m.ProxyFlowsMap,
+		m.ProxyPortsMap,
+		m.TriggeredMap,
+		m.TriggeredVipsMap,
+		m.VipsMap,
 	)
 }
 
@@ -99,11 +155,15 @@ func (m *BPFMaps) Close() error {
 // It can be passed to LoadBPFObjects or ebpf.CollectionSpec.LoadAndAssign.
 type BPFPrograms struct {
 	PortClassifier *ebpf.Program `ebpf:"port_classifier"`
+	PortXdp        *ebpf.Program `ebpf:"port_xdp"`
+	VipConnect     *ebpf.Program `ebpf:"vip_connect"`
 }
 
 func (p *BPFPrograms) Close() error {
 	return _BPFClose(
 		p.PortClassifier,
+		p.PortXdp,
+		p.VipConnect,
 	)
 }
 
@@ -0,0 +1,281 @@
+package bpf_port_listen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// Return codes of the classifier, linux/pkt_cls.h
+const (
+	tcActOK   = 0
+	tcActShot = 2
+)
+
+const (
+	ethPIPv4 = 0x0800
+	ethPIPv6 = 0x86DD
+
+	ipv6HopByHop = 0
+	ipv6DestOpts = 60
+)
+
+// classifierObjects loads the programs with connections held, as with
+// MaxHold set, skipping the test where BPF can't be used
+func classifierObjects(t *testing.T) (*BPFObjects, *ringbuf.Reader) {
+	t.Helper()
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		t.Skipf("removing memlock limit: %v", err)
+	}
+	spec, err := LoadBPF()
+	if err != nil {
+		t.Fatalf("loading spec: %v", err)
+	}
+	if err := spec.RewriteConstants(map[string]interface{}{
+		"use_ringbuf":      uint32(1),
+		"hold_connections": uint32(1),
+	}); err != nil {
+		t.Fatalf("setting constants: %v", err)
+	}
+
+	var objs BPFObjects
+	if err := spec.LoadAndAssign(&objs, nil); err != nil {
+		var verifierErr *ebpf.VerifierError
+		if !errors.As(err, &verifierErr) && (errors.Is(err, os.ErrPermission) || errors.Is(err, ebpf.ErrNotSupported)) {
+			t.Skipf("can't load BPF programs: %v", err)
+		}
+		t.Fatalf("loading objects: %v", err)
+	}
+	t.Cleanup(func() { objs.Close() })
+
+	events, err := ringbuf.NewReader(objs.Events)
+	if err != nil {
+		t.Fatalf("creating event reader: %v", err)
+	}
+	t.Cleanup(func() { events.Close() })
+
+	return &objs, events
+}
+
+// tcpHeader is a bare TCP header to port, with only the given flags set
+func tcpHeader(sport, dport uint16, seq uint32, syn, ack bool) []byte {
+	h := make([]byte, 20)
+	binary.BigEndian.PutUint16(h[0:], sport)
+	binary.BigEndian.PutUint16(h[2:], dport)
+	binary.BigEndian.PutUint32(h[4:], seq)
+	h[12] = 5 << 4 // data offset
+	if syn {
+		h[13] |= 0x02
+	}
+	if ack {
+		h[13] |= 0x10
+	}
+	return h
+}
+
+func ethernet(proto uint16, payload []byte) []byte {
+	frame := make([]byte, 14, 14+len(payload))
+	binary.BigEndian.PutUint16(frame[12:], proto)
+	return append(frame, payload...)
+}
+
+func ipv4Packet(saddr [4]byte, protocol uint8, payload []byte) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45 // version 4, 5 words
+	binary.BigEndian.PutUint16(h[2:], uint16(20+len(payload)))
+	h[8] = 64
+	h[9] = protocol
+	copy(h[12:], saddr[:])
+	copy(h[16:], []byte{10, 0, 0, 2})
+	return ethernet(ethPIPv4, append(h, payload...))
+}
+
+// ipv6Packet builds an IPv6 packet, with each of exts as an extension header
+// of the given type before the transport header
+func ipv6Packet(saddr [16]byte, protocol uint8, payload []byte, exts ...uint8) []byte {
+	var body []byte
+	next := protocol
+	for i := len(exts) - 1; i >= 0; i-- {
+		// Options padded to 16 bytes, hdrlen counts 8 byte units after the first
+		ext := make([]byte, 16)
+		ext[0] = next
+		ext[1] = 1
+		ext[2] = 1 // PadN covering the rest
+		ext[3] = 12
+		body = append(ext, body...)
+		next = exts[i]
+	}
+	body = append(body, payload...)
+
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(len(body)))
+	h[6] = next
+	h[7] = 64
+	copy(h[8:], saddr[:])
+	h[39] = 1
+	return ethernet(ethPIPv6, append(h, body...))
+}
+
+func runClassifier(t *testing.T, objs *BPFObjects, packet []byte) uint32 {
+	t.Helper()
+	ret, err := objs.PortClassifier.Run(&ebpf.RunOptions{Data: packet})
+	if err != nil {
+		t.Fatalf("running classifier: %v", err)
+	}
+	return ret
+}
+
+// readEvent returns the next event, or nil if there is none
+func readEvent(t *testing.T, events *ringbuf.Reader) []byte {
+	t.Helper()
+	events.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	record, err := events.Read()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("reading event: %v", err)
+	}
+	return record.RawSample
+}
+
+func decodeWakeEvent(t *testing.T, sample []byte) BPFWakeEvent {
+	t.Helper()
+	var event BPFWakeEvent
+	if err := binary.Read(bytes.NewReader(sample), binary.NativeEndian, &event); err != nil {
+		t.Fatalf("decoding event %v: %v", sample, err)
+	}
+	return event
+}
+
+func TestClassifierWakesArmedPorts(t *testing.T) {
+	objs, events := classifierObjects(t)
+
+	v4 := [4]byte{192, 0, 2, 1}
+	v6 := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+
+	tests := []struct {
+		name   string
+		port   uint16
+		packet []byte
+	}{
+		{"IPv4", 8080, ipv4Packet(v4, syscall.IPPROTO_TCP, tcpHeader(40000, 8080, 1, true, false))},
+		{"IPv6", 8081, ipv6Packet(v6, syscall.IPPROTO_TCP, tcpHeader(40000, 8081, 1, true, false))},
+		{"IPv6 extension headers", 8082, ipv6Packet(v6, syscall.IPPROTO_TCP, tcpHeader(40000, 8082, 1, true, false), ipv6HopByHop, ipv6DestOpts)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := BPFPortKey{Port: tt.port, Protocol: syscall.IPPROTO_TCP}
+			if err := objs.PortsMap.Put(key, uint32(1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := objs.PortHitsMap.Put(key, uint64(0)); err != nil {
+				t.Fatal(err)
+			}
+
+			if ret := runClassifier(t, objs, tt.packet); ret != tcActShot {
+				t.Errorf("SYN returned %d, want it held with %d", ret, tcActShot)
+			}
+
+			sample := readEvent(t, events)
+			if sample == nil {
+				t.Fatal("no wake event")
+			}
+			if event := decodeWakeEvent(t, sample); event.Port != key || event.Vip != (BPFVipKey{}) || event.PayloadLen != 0 {
+				t.Errorf("got event %+v, want port %+v", event, key)
+			}
+
+			var triggered uint8
+			if err := objs.TriggeredMap.Lookup(key, &triggered); err != nil {
+				t.Errorf("port not triggered: %v", err)
+			}
+
+			// Later packets are counted, but don't wake the service again
+			runClassifier(t, objs, tt.packet)
+			if sample := readEvent(t, events); sample != nil {
+				t.Errorf("got a second wake event %v", sample)
+			}
+			var hits uint64
+			if err := objs.PortHitsMap.Lookup(key, &hits); err != nil || hits != 2 {
+				t.Errorf("got %d hits (%v), want 2", hits, err)
+			}
+		})
+	}
+
+	t.Run("unarmed port", func(t *testing.T) {
+		packet := ipv4Packet(v4, syscall.IPPROTO_TCP, tcpHeader(40000, 9090, 1, true, false))
+		if ret := runClassifier(t, objs, packet); ret != tcActOK {
+			t.Errorf("returned %d, want %d", ret, tcActOK)
+		}
+		if sample := readEvent(t, events); sample != nil {
+			t.Errorf("got wake event %v", sample)
+		}
+	})
+}
+
+func TestClassifierSendsProxyConnectionStart(t *testing.T) {
+	objs, events := classifierObjects(t)
+
+	const port = 443
+	if err := objs.ProxyPortsMap.Put(uint16(port), uint32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	v4 := [4]byte{192, 0, 2, 1}
+	const seq = 1000
+	if ret := runClassifier(t, objs, ipv4Packet(v4, syscall.IPPROTO_TCP, tcpHeader(40001, port, seq, true, false))); ret != tcActOK {
+		t.Errorf("proxy SYN returned %d, want %d", ret, tcActOK)
+	}
+
+	// A segment merged by GRO, longer than one event
+	payload := make([]byte, 2000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	segment := append(tcpHeader(40001, port, seq+1, false, true), payload...)
+	runClassifier(t, objs, ipv4Packet(v4, syscall.IPPROTO_TCP, segment))
+
+	var got []byte
+	for _, wantOffset := range []uint32{0, maxProxyData / 2} {
+		sample := readEvent(t, events)
+		if sample == nil {
+			t.Fatalf("no proxy event at offset %d", wantOffset)
+		}
+		event := decodeWakeEvent(t, sample)
+		if event.PayloadOffset != wantOffset || event.Port.Port != port {
+			t.Errorf("got event %+v, want offset %d on port %d", event, wantOffset, port)
+		}
+		got = append(got, sample[proxyEventHeaderSize:proxyEventHeaderSize+int(event.PayloadLen)]...)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %d bytes of payload, want the %d sent", len(got), len(payload))
+	}
+
+	// Once the first PROXY_BYTES were sent the connection is forgotten
+	more := append(tcpHeader(40001, port, seq+1+uint32(len(payload)), false, true), payload...)
+	runClassifier(t, objs, ipv4Packet(v4, syscall.IPPROTO_TCP, more))
+	for {
+		sample := readEvent(t, events)
+		if sample == nil {
+			break
+		}
+		if event := decodeWakeEvent(t, sample); event.PayloadOffset+event.PayloadLen > maxProxyData {
+			t.Errorf("got event %+v past the start of the connection", event)
+		}
+	}
+	var start uint32
+	if err := objs.ProxyFlowsMap.Lookup(BPFFlowKey{Saddr: [16]uint8{10: 0xff, 11: 0xff, 12: 192, 13: 0, 14: 2, 15: 1}, Sport: 40001, Dport: port}, &start); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		t.Errorf("connection still tracked with start %d: %v", start, err)
+	}
+}
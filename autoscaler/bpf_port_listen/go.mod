@@ -3,7 +3,7 @@ module bpf_port_listen
 go 1.21.9
 
 require (
-	github.com/cilium/ebpf v0.14.0
+	github.com/cilium/ebpf v0.15.0
 	github.com/vishvananda/netlink v1.1.0
 )
 
@@ -22,3 +22,7 @@ replace server => ../server
 require logging v0.0.0
 
 replace logging => ../logging
+
+require bpf_events v0.0.0
+
+replace bpf_events => ../bpf_events
@@ -0,0 +1,85 @@
+package bpf_port_listen
+
+import (
+	"fmt"
+	"logging"
+	"server"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// How often the replicas of a held service are checked
+const holdPollPeriod = time.Second
+
+var heldServices sync.Map // map[serviceID]struct{}
+
+// hold keeps the service's ports armed, so new TCP connections to them are
+// dropped until a replica is running or MaxHold has passed. Clients
+// retransmit their SYN and connect once the ports are disarmed, rather than
+// being reset by a routing mesh port with no backends. The other ports are
+// marked triggered so they don't report the same wake-up again.
+func (s *BPFListener) hold(serviceID string) {
+	heldServices.Store(serviceID, struct{}{})
+
+	for _, port := range servicePorts(serviceID) {
+		key, err := portKey(port)
+		if err != nil {
+			continue
+		}
+		if err := s.TriggeredMap.Update(key, uint8(1), ebpf.UpdateAny); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to mark port %s triggered: %v", port, err))
+		}
+	}
+	logging.AddEventLog(fmt.Sprintf("Holding new connections to service %s for up to %s", serviceID, s.MaxHold))
+
+	go s.releaseWhenRunning(serviceID)
+}
+
+// releaseWhenRunning disarms the service's ports once its first replica runs
+func (s *BPFListener) releaseWhenRunning(serviceID string) {
+	defer heldServices.Delete(serviceID)
+
+	start := time.Now()
+	for time.Since(start) < s.MaxHold {
+		time.Sleep(holdPollPeriod)
+
+		running, err := s.replicaRunning(serviceID)
+		if err != nil {
+			logging.AddEventLog(fmt.Sprintf("Couldn't check replicas of service %s: %v", serviceID, err))
+			continue
+		}
+		if running {
+			logging.AddEventLog(fmt.Sprintf("Service %s running after %s, releasing held connections", serviceID, time.Since(start).Round(time.Millisecond)))
+			s.disarm(serviceID)
+			return
+		}
+	}
+
+	logging.AddEventLog(fmt.Sprintf("Service %s not running after %s, releasing held connections", serviceID, s.MaxHold))
+	s.disarm(serviceID)
+}
+
+// replicaRunning reports whether a replica of the service is running, asking
+// the manager when called on a worker
+func (s *BPFListener) replicaRunning(serviceID string) (bool, error) {
+	var status server.ReplicaStatus
+	var err error
+
+	nodeInfo := s.nodeInfo()
+	if nodeInfo.AutoscalerManager {
+		status, err = s.Scaler.ServiceReplicas(serviceID)
+	} else {
+		var manager server.SwarmNode
+		if manager, err = server.GetManagerNode(nodeInfo.OtherNodes); err != nil {
+			return false, err
+		}
+		status, err = server.SendReplicasRequest(serviceID, manager.IP)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return status.Running > 0, nil
+}
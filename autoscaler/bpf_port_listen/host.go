@@ -0,0 +1,289 @@
+package bpf_port_listen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"logging"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// Connection starts cut short, kept while waiting for their next segment.
+// Those of connections that never send it are dropped when this many pile up.
+const maxPendingData = 1024
+
+// Bytes at the start of a connection the classifier sends, PROXY_BYTES
+const maxProxyData = 2 * 1460
+
+// TLS record and handshake types
+const (
+	tlsHandshake   = 0x16
+	tlsClientHello = 0x01
+	tlsServerName  = 0x0000 // extension
+)
+
+var (
+	hostToServiceID sync.Map   // map[host]serviceID
+	proxyPortsMu    sync.Mutex // serialises arming proxy_ports_map
+)
+
+// Size of a proxy_event before its payload
+var proxyEventHeaderSize = binary.Size(BPFWakeEvent{}) + binary.Size(BPFFlowKey{})
+
+// serviceHosts returns the hostnames armed for a service
+func serviceHosts(serviceID string) []string {
+	var hosts []string
+	hostToServiceID.Range(func(key, value interface{}) bool {
+		if value.(string) == serviceID {
+			hosts = append(hosts, key.(string))
+		}
+		return true
+	})
+	return hosts
+}
+
+// normalizeHost lower cases a hostname and strips any port or trailing dot
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ListenOnHost wakes the service when a new connection to one of the proxy
+// ports asks for host, in its HTTP Host header or TLS SNI. Services behind a
+// shared reverse proxy have no published port of their own.
+func (s *BPFListener) ListenOnHost(host string, serviceID string) error {
+	if len(s.proxyPorts) == 0 {
+		return fmt.Errorf("no proxy ports configured to listen on host %s", host)
+	}
+
+	hostToServiceID.Store(normalizeHost(host), serviceID)
+	if err := s.armProxyPorts(); err != nil {
+		return err
+	}
+
+	logging.AddEventLog(fmt.Sprintf("Listening on host %s for service %s", host, serviceID))
+	return nil
+}
+
+func (s *BPFListener) RemoveHost(host string) error {
+	host = normalizeHost(host)
+	if _, ok := hostToServiceID.Load(host); !ok {
+		return fmt.Errorf("service ID for host %s not found in RemoveHost", host)
+	}
+	hostToServiceID.Delete(host)
+
+	if err := s.armProxyPorts(); err != nil {
+		return err
+	}
+
+	logging.AddEventLog(fmt.Sprintf("Removed host %s", host))
+	return nil
+}
+
+// armProxyPorts watches the proxy ports while any host is armed, so the
+// classifier only copies proxy traffic to user space when it may wake a
+// service
+func (s *BPFListener) armProxyPorts() error {
+	proxyPortsMu.Lock()
+	defer proxyPortsMu.Unlock()
+
+	armed := false
+	hostToServiceID.Range(func(key, value interface{}) bool {
+		armed = true
+		return false
+	})
+
+	for _, port := range s.proxyPorts {
+		if armed {
+			if err := s.ProxyPortsMap.Update(port, uint32(1), ebpf.UpdateAny); err != nil {
+				return fmt.Errorf("failed to add proxy port %d to BPF map: %v", port, err)
+			}
+		} else if err := s.ProxyPortsMap.Delete(port); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove proxy port %d from BPF map: %v", port, err)
+		}
+	}
+	return nil
+}
+
+// handleProxyEvent looks for the hostname in the start of a proxy connection
+// and wakes its service. The start of the connection is put back together
+// from the events by their offset, until the hostname is found or the
+// classifier stops sending. The classifier is then told to forget the
+// connection.
+func (s *BPFListener) handleProxyEvent(event BPFWakeEvent, sample []byte) {
+	if len(sample) < proxyEventHeaderSize+int(event.PayloadLen) {
+		logging.AddEventLog(fmt.Sprintf("Received truncated proxy event of %d bytes", len(sample)))
+		return
+	}
+
+	var flow BPFFlowKey
+	binary.Read(bytes.NewReader(sample[binary.Size(event):]), binary.NativeEndian, &flow)
+	payload := sample[proxyEventHeaderSize : proxyEventHeaderSize+int(event.PayloadLen)]
+
+	data := s.pendingData[flow]
+	offset := int(event.PayloadOffset)
+	if offset+len(payload) <= len(data) {
+		return // retransmitted
+	}
+
+	host, more := "", false
+	if offset <= len(data) {
+		data = append(data, payload[len(data)-offset:]...)
+		host, more = requestHost(data)
+	} // else a segment went missing, the hostname can't be found
+	delete(s.pendingData, flow)
+
+	if more && len(data) < maxProxyData {
+		if len(s.pendingData) >= maxPendingData {
+			clear(s.pendingData)
+		}
+		s.pendingData[flow] = data
+		return
+	}
+
+	if err := s.ProxyFlowsMap.Delete(flow); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		logging.AddEventLog(fmt.Sprintf("Failed to remove proxy connection from BPF map: %v", err))
+	}
+	if host != "" {
+		s.wakeHost(host, event.Port.Port)
+	}
+}
+
+// wakeHost scales the service reached by host back up
+func (s *BPFListener) wakeHost(host string, port uint16) {
+	serviceID, ok := hostToServiceID.Load(host)
+	if !ok {
+		return // most proxy traffic is for services that are running
+	}
+	if _, held := heldServices.Load(serviceID); held {
+		return // already waking up
+	}
+	logging.AddEventLog(fmt.Sprintf("Connection for host %s on proxy port %d, triggering scale action for service %s", host, port, serviceID))
+	s.wakeService(serviceID.(string))
+}
+
+// requestHost returns the hostname a client asks for at the start of a
+// connection, from the Host header of an HTTP request or the SNI of a TLS
+// ClientHello. more is set when data ends before the hostname could be
+// found.
+func requestHost(data []byte) (host string, more bool) {
+	if len(data) > 0 && data[0] == tlsHandshake {
+		return clientHelloServerName(data)
+	}
+	return httpHost(data)
+}
+
+// httpHost finds the Host header of an HTTP/1 request
+func httpHost(data []byte) (string, bool) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end >= 0 {
+		data = data[:end]
+	}
+
+	lines := bytes.Split(data, []byte("\r\n"))
+	if end < 0 {
+		lines = lines[:len(lines)-1] // the last line may be cut short
+	}
+	for i, line := range lines {
+		if i == 0 {
+			continue // request line
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && strings.EqualFold(string(name), "host") {
+			return normalizeHost(string(value)), false
+		}
+	}
+
+	return "", end < 0 && looksLikeHTTP(data)
+}
+
+// looksLikeHTTP reports whether data starts with a request method, so a
+// request cut short is worth waiting for
+func looksLikeHTTP(data []byte) bool {
+	method, _, ok := bytes.Cut(data, []byte(" "))
+	if !ok || len(method) == 0 || len(method) > 10 {
+		return false
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// tlsReader reads the big endian fields of a TLS message, remembering if the
+// data ran out
+type tlsReader struct {
+	data  []byte
+	short bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.short || len(r.data) < n {
+		r.short = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint(n int) int {
+	v := 0
+	for _, b := range r.bytes(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// vector reads a field prefixed by its length in n bytes
+func (r *tlsReader) vector(n int) []byte {
+	return r.bytes(r.uint(n))
+}
+
+// clientHelloServerName finds the server_name extension of a TLS ClientHello
+// in its first record
+func clientHelloServerName(data []byte) (string, bool) {
+	r := &tlsReader{data: data}
+	r.bytes(5) // record type, version and length
+	if r.uint(1) != tlsClientHello {
+		return "", r.short
+	}
+	r.bytes(3 + 2 + 32) // handshake length, client version and random
+	r.vector(1)         // session ID
+	r.vector(2)         // cipher suites
+	r.vector(1)         // compression methods
+
+	extensions := &tlsReader{data: r.vector(2)}
+	if r.short {
+		return "", true
+	}
+	for !extensions.short && len(extensions.data) > 0 {
+		extType := extensions.uint(2)
+		body := extensions.vector(2)
+		if extType != tlsServerName {
+			continue
+		}
+
+		names := &tlsReader{data: body}
+		names = &tlsReader{data: names.vector(2)}
+		for !names.short && len(names.data) > 0 {
+			nameType := names.uint(1)
+			name := names.vector(2)
+			if nameType == 0 && !names.short { // host_name
+				return normalizeHost(string(name)), false
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
@@ -0,0 +1,119 @@
+package bpf_port_listen
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// vector prefixes data with its length in n bytes
+func vector(n int, data []byte) []byte {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(data)))
+	return append(length[8-n:], data...)
+}
+
+// clientHello builds a TLS record with a ClientHello for serverName, after
+// an extension of padding bytes. No server_name extension is sent for an
+// empty serverName.
+func clientHello(serverName string, padding int) []byte {
+	var extensions []byte
+	extensions = append(extensions, 0x00, 0x15) // padding
+	extensions = append(extensions, vector(2, make([]byte, padding))...)
+	if serverName != "" {
+		name := append([]byte{0}, vector(2, []byte(serverName))...) // host_name
+		extensions = append(extensions, serverNameExtension(vector(2, name))...)
+	}
+	return clientHelloRecord(extensions)
+}
+
+func serverNameExtension(body []byte) []byte {
+	return append([]byte{0x00, 0x00}, vector(2, body)...)
+}
+
+// clientHelloRecord builds a TLS record with a ClientHello carrying the raw
+// extensions
+func clientHelloRecord(extensions []byte) []byte {
+	var body []byte
+	body = append(body, 0x03, 0x03)          // client version
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, vector(1, nil)...)   // session ID
+	body = append(body, vector(2, []byte{0x13, 0x01})...)
+	body = append(body, vector(1, []byte{0})...) // compression methods
+	body = append(body, vector(2, extensions)...)
+
+	handshake := append([]byte{tlsClientHello}, vector(3, body)...)
+	return append([]byte{tlsHandshake, 0x03, 0x01}, vector(2, handshake)...)
+}
+
+func TestRequestHost(t *testing.T) {
+	hello := clientHello("App.Example.com.", 0)
+	bigHello := clientHello("big.example.com", 2000) // over two segments, the name in the second
+	request := []byte("GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: web.example.com:8080\r\n\r\n")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantHost string
+		wantMore bool
+	}{
+		{"ClientHello", hello, "app.example.com", false},
+		{"ClientHello cut in the record header", hello[:3], "", true},
+		{"ClientHello cut before the extensions", hello[:50], "", true},
+		{"ClientHello cut in the server name", hello[:len(hello)-4], "", true},
+		{"ClientHello over two segments", bigHello, "big.example.com", false},
+		{"first segment of a large ClientHello", bigHello[:1460], "", true},
+		{"ClientHello without server name", clientHello("", 16), "", false},
+		{"handshake other than a ClientHello", append([]byte{tlsHandshake, 3, 1, 0, 4, 0x02}, make([]byte, 40)...), "", false},
+		{"server name list longer than its extension", clientHelloRecord(serverNameExtension([]byte{0xff, 0xff, 0, 0, 1, 'a'})), "", false},
+		{"server name longer than its list", clientHelloRecord(serverNameExtension(vector(2, []byte{0, 0xff, 0xff, 'a'}))), "", false},
+		{"server name of another type", clientHelloRecord(serverNameExtension(vector(2, append([]byte{1}, vector(2, []byte("a.example.com"))...)))), "", false},
+
+		{"HTTP request", request, "web.example.com", false},
+		{"HTTP request without headers yet", []byte("GET / HTTP/1.1\r\n"), "", true},
+		{"HTTP request cut in the Host header", request[:len(request)-10], "", true},
+		{"HTTP request without Host", []byte("GET / HTTP/1.0\r\nAccept: */*\r\n\r\n"), "", false},
+		{"HTTP request line in lower case", []byte("get / HTTP/1.1\r\n"), "", false},
+		{"not HTTP", []byte("\x00\x01binary"), "", false},
+		{"empty", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, more := requestHost(tt.data)
+			if host != tt.wantHost || more != tt.wantMore {
+				t.Errorf("requestHost() = %q, %v, want %q, %v", host, more, tt.wantHost, tt.wantMore)
+			}
+		})
+	}
+}
+
+func TestClientHelloServerNameSplit(t *testing.T) {
+	hello := clientHello("split.example.com", 100)
+
+	// Every prefix asks for more, until the name is complete
+	for i := 0; i < len(hello); i++ {
+		if host, more := clientHelloServerName(hello[:i]); host != "" || !more {
+			t.Fatalf("%d of %d bytes: got %q, %v, want to wait for more", i, len(hello), host, more)
+		}
+	}
+	if host, more := clientHelloServerName(hello); host != "split.example.com" || more {
+		t.Errorf("got %q, %v, want split.example.com", host, more)
+	}
+}
+
+func TestHTTPHostSplit(t *testing.T) {
+	request := []byte("POST /api HTTP/1.1\r\nHOST: Split.Example.com\r\nContent-Length: 0\r\n\r\n")
+
+	// The Host header line is only used once it is complete
+	hostEnd := len("POST /api HTTP/1.1\r\nHOST: Split.Example.com\r\n")
+	for i := 0; i < hostEnd; i++ {
+		if host, more := httpHost(request[:i]); host != "" || (i > len("POST") && !more) {
+			t.Fatalf("%d bytes: got %q, %v, want to wait for more", i, host, more)
+		}
+	}
+	for i := hostEnd; i <= len(request); i++ {
+		if host, more := httpHost(request[:i]); host != "split.example.com" || more {
+			t.Fatalf("%d bytes: got %q, %v, want split.example.com", i, host, more)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package bpf_port_listen
+
+import (
+	"fmt"
+	"logging"
+	"net"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+)
+
+// AutoIface in ListenerConfig.Ifaces picks interfaces by their routes
+const AutoIface = "auto"
+
+// Link and route updates come in bursts, when a container starts or a
+// network is created. They are synced together after this delay.
+const interfaceSyncDelay = 500 * time.Millisecond
+
+// Attach modes of the classifier
+const (
+	AttachTC         = "tc"
+	AttachXDP        = "xdp" // native, or generic where the driver lacks support
+	AttachXDPGeneric = "xdp-generic"
+)
+
+// attach runs the classifier on an interface in the configured mode and
+// returns the mode actually used
+func (s *BPFListener) attach(index int) (link.Link, string, error) {
+	switch s.attachMode {
+	case AttachXDP:
+		l, err := link.AttachXDP(link.XDPOptions{
+			Program:   s.xdpProgram,
+			Interface: index,
+			Flags:     link.XDPDriverMode,
+		})
+		if err == nil {
+			return l, "native XDP", nil
+		}
+		logging.AddEventLog(fmt.Sprintf("Native XDP not supported on interface %d, falling back to generic XDP: %v", index, err))
+		fallthrough
+	case AttachXDPGeneric:
+		l, err := link.AttachXDP(link.XDPOptions{
+			Program:   s.xdpProgram,
+			Interface: index,
+			Flags:     link.XDPGenericMode,
+		})
+		return l, "generic XDP", err
+	default:
+		l, err := link.AttachTCX(link.TCXOptions{
+			Program:   s.program,
+			Interface: index,
+			Attach:    ebpf.AttachTCXIngress,
+		})
+		return l, "TCX", err
+	}
+}
+
+func (s *BPFListener) autoIfaces() bool {
+	return len(s.ifaces) == 1 && s.ifaces[0] == AutoIface
+}
+
+// wantedInterfaces returns the interfaces the classifier should be attached
+// to, by index. In auto mode these are the interfaces with a default route,
+// and those routing to the other swarm nodes, where the ingress network
+// traffic arrives.
+func (s *BPFListener) wantedInterfaces() (map[int]string, error) {
+	wanted := make(map[int]string)
+
+	if !s.autoIfaces() {
+		for _, name := range s.ifaces {
+			iface, err := netlink.LinkByName(name)
+			if err != nil {
+				continue // may be created later
+			}
+			wanted[iface.Attrs().Index] = name
+		}
+		return wanted, nil
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("listing routes: %v", err)
+	}
+	var indexes []int
+	for _, route := range routes {
+		if route.Dst == nil || isDefaultRoute(route.Dst) {
+			indexes = append(indexes, route.LinkIndex)
+		}
+	}
+	for _, node := range s.nodeInfo().OtherNodes {
+		ip := net.ParseIP(node.IP)
+		if ip == nil {
+			continue
+		}
+		if nodeRoutes, err := netlink.RouteGet(ip); err == nil && len(nodeRoutes) > 0 {
+			indexes = append(indexes, nodeRoutes[0].LinkIndex)
+		}
+	}
+
+	for _, index := range indexes {
+		iface, err := netlink.LinkByIndex(index)
+		if err != nil || iface.Attrs().Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		wanted[index] = iface.Attrs().Name
+	}
+	return wanted, nil
+}
+
+func isDefaultRoute(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// syncInterfaces attaches the classifier to wanted interfaces it isn't on yet
+// and detaches it from those no longer wanted
+func (s *BPFListener) syncInterfaces() error {
+	wanted, err := s.wantedInterfaces()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for index, name := range wanted {
+		if _, attached := s.Links[index]; attached {
+			continue
+		}
+		l, mode, err := s.attach(index)
+		if err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to attach port listener to %s: %v", name, err))
+			continue
+		}
+		s.Links[index] = l
+		logging.AddEventLog(fmt.Sprintf("Port listener attached to %s with %s", name, mode))
+	}
+
+	for index, l := range s.Links {
+		if _, ok := wanted[index]; ok {
+			continue
+		}
+		l.Close()
+		delete(s.Links, index)
+		logging.AddEventLog(fmt.Sprintf("Port listener detached from interface %d", index))
+	}
+
+	return nil
+}
+
+// followInterfaces keeps the attachments in sync as links, and in auto mode
+// routes, are added and removed. In auto mode nothing is attached before
+// SetNodeInfo.
+func (s *BPFListener) followInterfaces() {
+	links := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(links, s.closing); err != nil {
+		logging.AddEventLog(fmt.Sprintf("Failed to subscribe to link updates: %v", err))
+		return
+	}
+
+	var routes chan netlink.RouteUpdate // never ready unless in auto mode
+	if s.autoIfaces() {
+		routes = make(chan netlink.RouteUpdate)
+		if err := netlink.RouteSubscribe(routes, s.closing); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to subscribe to route updates: %v", err))
+			routes = nil
+		}
+	}
+
+	var pending <-chan time.Time // ready once the updates of a burst are in
+	for {
+		select {
+		case <-s.closing:
+			return
+		case _, ok := <-links:
+			if !ok {
+				return
+			}
+		case _, ok := <-routes:
+			if !ok {
+				routes = nil
+				continue
+			}
+		case <-pending:
+			pending = nil
+			if !s.syncReady() {
+				continue
+			}
+			if err := s.syncInterfaces(); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to update port listener interfaces: %v", err))
+			}
+			continue
+		}
+
+		if pending == nil {
+			pending = time.After(interfaceSyncDelay)
+		}
+	}
+}
+
+// syncReady reports whether the interfaces can be picked, in auto mode this
+// needs the other nodes
+func (s *BPFListener) syncReady() bool {
+	if !s.autoIfaces() {
+		return true
+	}
+	s.nodeInfoMu.Lock()
+	defer s.nodeInfoMu.Unlock()
+	return s.nodeInfoSet
+}
@@ -1,47 +1,82 @@
 package bpf_port_listen
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang BPF bpf/tc-port-monitor.c -- -I/usr/include/bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -type wake_event -type flow_key BPF bpf/tc-port-monitor.c -- -I/usr/include/bpf
 
 import (
+	"bpf_events"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"logging"
-	"os"
 	"server"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/perf"
 	"github.com/cilium/ebpf/rlimit"
-	"github.com/vishvananda/netlink"
 )
 
 type Scaler interface {
 	ScaleTo(serviceID string, replicas uint64) error
+	ServiceReplicas(serviceID string) (server.ReplicaStatus, error)
+}
+
+// ListenerConfig sets up the port listener
+type ListenerConfig struct {
+	Ifaces     []string      // interfaces the classifier is attached to, or just AutoIface
+	MaxHold    time.Duration // hold new connections while waking a service for at most this long, 0 to let them through
+	AttachMode string        // AttachTC, AttachXDP or AttachXDPGeneric
+	ProxyPorts []uint16      // TCP ports of a reverse proxy in front of services woken by hostname
+}
+
+// Protocols the classifier can match, by the name Docker uses
+var protocolNumbers = map[string]uint8{
+	"tcp": syscall.IPPROTO_TCP,
+	"udp": syscall.IPPROTO_UDP,
 }
 
 var (
-	portToServiceID  sync.Map
+	portToServiceID  sync.Map // map[server.PublishedPort]string
 	listenerInstance *BPFListener
 	once             sync.Once
 )
 
 type BPFListener struct {
-	PerfReader    *perf.Reader
+	EventReader   *bpf_events.Reader
 	PortsMap      *ebpf.Map
+	TriggeredMap  *ebpf.Map
+	PortHitsMap   *ebpf.Map
+	VIPsMap       *ebpf.Map
+	TriggeredVIPs *ebpf.Map
+	VIPLink       link.Link
+	ProxyPortsMap *ebpf.Map
+	ProxyFlowsMap *ebpf.Map
 	EventsMap     *ebpf.Map
-	Link          link.Link
+	Links         map[int]link.Link // by interface index
+	MaxHold       time.Duration
+	program       *ebpf.Program
+	xdpProgram    *ebpf.Program
+	attachMode    string
+	ifaces        []string
+	proxyPorts    []uint16
+	pendingData   map[BPFFlowKey][]byte // only used by listenForEvents
+	mu            sync.Mutex
 	closing       chan struct{}
 	Scaler        Scaler
-	SwarmNodeInfo server.SwarmNodeInfo
+	swarmNodeInfo server.SwarmNodeInfo
+	nodeInfoSet   bool
+	nodeInfoMu    sync.Mutex // guards swarmNodeInfo and nodeInfoSet, read by followInterfaces
 }
 
-func GetBPFListener(ifaceName string) (*BPFListener, error) {
+func GetBPFListener(config ListenerConfig) (*BPFListener, error) {
 	var err error
 	once.Do(func() {
-		listenerInstance, err = initBPFPortListener(ifaceName)
+		listenerInstance, err = initBPFPortListener(config)
 	})
 	return listenerInstance, err
 }
@@ -51,151 +86,360 @@ func (s *BPFListener) SetScaler(scale Scaler) {
 }
 
 func (s *BPFListener) SetNodeInfo(nodeInfo server.SwarmNodeInfo) {
-	s.SwarmNodeInfo = nodeInfo
+	s.nodeInfoMu.Lock()
+	s.swarmNodeInfo = nodeInfo
+	s.nodeInfoSet = true
+	s.nodeInfoMu.Unlock()
+
+	// The routes to the other nodes pick interfaces in auto mode, so the
+	// first attach waits for them
+	if s.autoIfaces() {
+		if err := s.syncInterfaces(); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to update port listener interfaces: %v", err))
+		}
+		s.mu.Lock()
+		if len(s.Links) == 0 {
+			logging.AddEventLog("Port listener not attached to any interface yet, waiting for routes to the other nodes")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *BPFListener) nodeInfo() server.SwarmNodeInfo {
+	s.nodeInfoMu.Lock()
+	defer s.nodeInfoMu.Unlock()
+	return s.swarmNodeInfo
 }
 
-func initBPFPortListener(ifaceName string) (*BPFListener, error) {
+func initBPFPortListener(config ListenerConfig) (*BPFListener, error) {
 	// Allow the current process to lock memory for eBPF resources.
 	if err := rlimit.RemoveMemlock(); err != nil {
 		return nil, fmt.Errorf("failed to remove memlock limit: %v", err)
 	}
 
-	objs := BPFObjects{}
-	if err := LoadBPFObjects(&objs, nil); err != nil {
-		return nil, fmt.Errorf("loading objects: %s", err)
+	spec, err := LoadBPF()
+	if err != nil {
+		return nil, fmt.Errorf("loading spec: %s", err)
 	}
 
-	iface, err := netlink.LinkByName(ifaceName)
+	useRingbuf, err := bpf_events.Configure(spec)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get interface by name %s: %v", ifaceName, err)
+		return nil, err
 	}
 
-	qlen, err := link.AttachTCX(link.TCXOptions{
-		Program:   objs.PortClassifier,
-		Interface: iface.Attrs().Index,
-		Attach:    ebpf.AttachTCXIngress,
-	})
+	switch config.AttachMode {
+	case AttachTC, AttachXDP, AttachXDPGeneric:
+	default:
+		return nil, fmt.Errorf("unknown attach mode %q", config.AttachMode)
+	}
+
+	holdConnections := uint32(0)
+	if config.MaxHold > 0 {
+		holdConnections = 1
+	}
+	// XDP can only read proxy connections whose data spans fragments with
+	// bpf_xdp_load_bytes
+	xdpProxy := uint32(1)
+	if err := features.HaveProgramHelper(ebpf.XDP, asm.FnXdpLoadBytes); err != nil {
+		xdpProxy = 0
+		if config.AttachMode != AttachTC && len(config.ProxyPorts) > 0 {
+			logging.AddEventLog(fmt.Sprintf("Proxy ports need bpf_xdp_load_bytes in XDP mode, services can't be woken by hostname: %v", err))
+		}
+	}
+
+	if err := spec.RewriteConstants(map[string]interface{}{
+		"hold_connections": holdConnections,
+		"xdp_proxy":        xdpProxy,
+	}); err != nil {
+		return nil, fmt.Errorf("setting hold mode: %v", err)
+	}
+
+	objs := BPFObjects{}
+	if err := spec.LoadAndAssign(&objs, nil); err != nil {
+		return nil, fmt.Errorf("loading objects: %s", err)
+	}
+
+	// Only services woken through their VIPs need the tracepoint
+	vipLink, err := link.Tracepoint("sock", "inet_sock_set_state", objs.VipConnect, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to attach TC program: %v", err)
+		logging.AddEventLog(fmt.Sprintf("Failed to attach VIP connect tracepoint, services can't be woken through their VIPs: %v", err))
+		vipLink = nil
 	}
 
-	pr, err := perf.NewReader(objs.Events, os.Getpagesize())
+	reader, err := bpf_events.NewReader("port listener", useRingbuf, objs.Events, objs.EventsPerf, objs.DroppedEvents)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create perf event reader: %v", err)
+		return nil, err
 	}
 
 	s := &BPFListener{
-		PerfReader: pr,
-		PortsMap:   objs.PortsMap,
-		EventsMap:  objs.Events,
-		Link:       qlen,
-		closing:    make(chan struct{}),
-		Scaler:     nil,
+		EventReader:   reader,
+		PortsMap:      objs.PortsMap,
+		TriggeredMap:  objs.TriggeredMap,
+		PortHitsMap:   objs.PortHitsMap,
+		VIPsMap:       objs.VipsMap,
+		TriggeredVIPs: objs.TriggeredVipsMap,
+		VIPLink:       vipLink,
+		ProxyPortsMap: objs.ProxyPortsMap,
+		ProxyFlowsMap: objs.ProxyFlowsMap,
+		EventsMap:     objs.Events,
+		Links:         make(map[int]link.Link),
+		MaxHold:       config.MaxHold,
+		program:       objs.PortClassifier,
+		xdpProgram:    objs.PortXdp,
+		attachMode:    config.AttachMode,
+		ifaces:        config.Ifaces,
+		proxyPorts:    config.ProxyPorts,
+		pendingData:   make(map[BPFFlowKey][]byte),
+		closing:       make(chan struct{}),
+		Scaler:        nil,
+	}
+
+	// In auto mode SetNodeInfo attaches, once the other nodes are known
+	if !s.autoIfaces() {
+		if err := s.syncInterfaces(); err != nil {
+			return nil, err
+		}
+		if len(s.Links) == 0 {
+			return nil, fmt.Errorf("failed to attach port listener to any of %v", config.Ifaces)
+		}
 	}
 
 	go s.listenForEvents()
+	go s.scanPortHits()
+	go s.followInterfaces()
 
 	return s, nil
 }
 
 func (s *BPFListener) Close() {
 	close(s.closing)
-	s.Link.Close()
-	s.PerfReader.Close()
+	s.mu.Lock()
+	for _, l := range s.Links {
+		l.Close()
+	}
+	s.mu.Unlock()
+	if s.VIPLink != nil {
+		s.VIPLink.Close()
+	}
+	s.EventReader.Close()
 }
 
 func (s *BPFListener) listenForEvents() {
-	logging.AddEventLog("BPF program setup, listening for perf events...")
+	logging.AddEventLog("BPF program setup, listening for events...")
 	for {
 		select {
 		case <-s.closing:
 			return
 		default:
-			record, err := s.PerfReader.Read()
+			sample, err := s.EventReader.Read()
 			if err != nil {
-				if err == perf.ErrClosed {
+				if errors.Is(err, bpf_events.ErrClosed) {
 					return // Exiting
 				}
-				logging.AddEventLog(fmt.Sprintf("Error reading perf event: %v", err))
+				logging.AddEventLog(fmt.Sprintf("Error reading event: %v", err))
 				continue
 			}
 
-			if len(record.RawSample) >= 4 { // Ensure there's enough data for a uint32
-				port := binary.LittleEndian.Uint32(record.RawSample[:4])
-				serviceID, ok := portToServiceID.Load(port)
-				if !ok {
-					logging.AddEventLog(fmt.Sprintf("Service ID for port %d removed, not blocking request", port))
-					continue
+			var event BPFWakeEvent
+			if err := binary.Read(bytes.NewReader(sample), binary.NativeEndian, &event); err == nil {
+				if event.PayloadLen > 0 {
+					s.handleProxyEvent(event, sample)
+				} else if event.Vip != (BPFVipKey{}) {
+					s.wakeVIP(vipAddr(event.Vip), event.Port.Port)
+				} else {
+					s.wake(publishedPort(event.Port))
 				}
-				logging.AddEventLog(fmt.Sprintf("Packet detected on port %d, triggering scale action for service %s", port, serviceID))
-				logging.AddScalingLog("up")
+			} else {
+				logging.AddEventLog(fmt.Sprintf("Received malformed event: %v", sample))
+			}
+		}
+	}
+}
 
-				// remove the port and scale back up
-				if err := s.RemovePort(port); err != nil {
-					logging.AddEventLog(fmt.Sprintf("Failed to remove port %d: %v", port, err))
-				}
+// wake scales the service owning port back up. Its ports are disarmed
+// straight away, or held until a replica runs when MaxHold is set.
+func (s *BPFListener) wake(port server.PublishedPort) {
+	serviceID, ok := portToServiceID.Load(port)
+	if !ok {
+		logging.AddEventLog(fmt.Sprintf("Service ID for port %s removed, not blocking request", port))
+		return
+	}
+	if _, held := heldServices.Load(serviceID); held {
+		return // already waking up
+	}
+	logging.AddEventLog(fmt.Sprintf("Packet detected on port %s, triggering scale action for service %s", port, serviceID))
+	s.wakeService(serviceID.(string))
+}
 
-				if err = server.SendRemoveRequestToAllNodes(s.SwarmNodeInfo, port); err != nil {
-					logging.AddEventLog(fmt.Sprintf("Failed to send remove request to all nodes: %v", err))
-				}
+// wakeService disarms or holds the service and scales it back up to 1
+func (s *BPFListener) wakeService(serviceID string) {
+	logging.AddScalingLog("up")
 
-				if s.SwarmNodeInfo.AutoscalerManager {
-					logging.AddEventLog(fmt.Sprintf("Scaling service %s back up", serviceID))
+	if s.MaxHold > 0 {
+		s.hold(serviceID)
+	} else {
+		s.disarm(serviceID)
+	}
 
-					// Call scaler to scale back up to 1.
-					s.Scaler.ScaleTo(serviceID.(string), 1)
-				} else {
-					logging.AddEventLog(fmt.Sprintf("Scaling service %s back up on manager node", serviceID))
+	nodeInfo := s.nodeInfo()
+	if nodeInfo.AutoscalerManager {
+		logging.AddEventLog(fmt.Sprintf("Scaling service %s back up", serviceID))
 
-					manager, err := server.GetManagerNode(s.SwarmNodeInfo.OtherNodes)
-					if err != nil {
-						logging.AddEventLog(fmt.Sprintf("Failed to get manager node to scale back up to 1 from worker: %v", err))
-					}
+		// Call scaler to scale back up to 1.
+		s.Scaler.ScaleTo(serviceID, 1)
+	} else {
+		logging.AddEventLog(fmt.Sprintf("Scaling service %s back up on manager node", serviceID))
 
-					// Send scale request to manager node from worker node
-					if err := server.SendScaleRequest(serviceID.(string), "over", manager.IP); err != nil {
-						logging.AddEventLog(fmt.Sprintf("Failed to send scale request to manager node: %v", err))
-					}
-				}
+		manager, err := server.GetManagerNode(nodeInfo.OtherNodes)
+		if err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to get manager node to scale back up to 1 from worker: %v", err))
+		}
 
-			} else {
-				logging.AddEventLog(fmt.Sprintf("Received malformed perf event: %v", record.RawSample))
-			}
+		// Send scale request to manager node from worker node
+		if err := server.SendScaleRequest(serviceID, "over", manager.IP); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to send scale request to manager node: %v", err))
+		}
+	}
+}
+
+// disarm removes all the service's ports, VIPs and hosts here and on the
+// other nodes
+func (s *BPFListener) disarm(serviceID string) {
+	nodeInfo := s.nodeInfo()
+	for _, port := range servicePorts(serviceID) {
+		if err := s.RemovePort(port); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to remove port %s: %v", port, err))
+		}
+
+		if err := server.SendRemoveRequestToAllNodes(nodeInfo, port); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to send remove request to all nodes: %v", err))
+		}
+	}
+
+	for _, vip := range serviceVIPs(serviceID) {
+		if err := s.RemoveVIP(vip); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to remove VIP %s: %v", vip, err))
+		}
+
+		if err := server.SendListenerRequestToAllNodes(nodeInfo, server.ListenerRequest{Kind: server.VIPTarget, Target: vip}); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to send remove VIP request to all nodes: %v", err))
+		}
+	}
+
+	for _, host := range serviceHosts(serviceID) {
+		if err := s.RemoveHost(host); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to remove host %s: %v", host, err))
+		}
+
+		if err := server.SendListenerRequestToAllNodes(nodeInfo, server.ListenerRequest{Kind: server.HostTarget, Target: host}); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to send remove host request to all nodes: %v", err))
+		}
+	}
+}
+
+// servicePorts returns the ports armed for a service
+func servicePorts(serviceID string) []server.PublishedPort {
+	var ports []server.PublishedPort
+	portToServiceID.Range(func(key, value interface{}) bool {
+		if value.(string) == serviceID {
+			ports = append(ports, key.(server.PublishedPort))
+		}
+		return true
+	})
+	return ports
+}
+
+// portKey converts a published port to its ports_map key
+func portKey(port server.PublishedPort) (BPFPortKey, error) {
+	protocol, ok := protocolNumbers[port.Protocol]
+	if !ok {
+		return BPFPortKey{}, fmt.Errorf("unsupported protocol %q for port %d", port.Protocol, port.Port)
+	}
+	return BPFPortKey{Port: uint16(port.Port), Protocol: protocol}, nil
+}
+
+// publishedPort converts a ports_map key back to the published port
+func publishedPort(key BPFPortKey) server.PublishedPort {
+	for name, number := range protocolNumbers {
+		if number == key.Protocol {
+			return server.PublishedPort{Port: uint32(key.Port), Protocol: name}
 		}
 	}
+	return server.PublishedPort{Port: uint32(key.Port), Protocol: fmt.Sprint(key.Protocol)}
 }
 
-func (s *BPFListener) ListenOnPort(port uint32, serviceID string) error {
+func (s *BPFListener) ListenOnPort(port server.PublishedPort, serviceID string) error {
+	key, err := portKey(port)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Can't listen on port %s for service %s: %v", port, serviceID, err))
+		return err
+	}
+
 	// Storing the service ID in the local Go map.
 	portToServiceID.Store(port, serviceID)
 
+	// Reset the state of any previous arming before traffic can be seen
+	if err := s.TriggeredMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to reset triggered state of port %s: %v", port, err)
+	}
+	if err := s.PortHitsMap.Put(key, uint64(0)); err != nil {
+		return fmt.Errorf("failed to reset hit count of port %s: %v", port, err)
+	}
+
 	var value uint32 = 1 // need a fixed value for the eBPF map
 
-	if err := s.PortsMap.Update(port, value, ebpf.UpdateAny); err != nil {
-		logging.AddEventLog(fmt.Sprintf("Failed to add port %d to BPF map: %v", port, err))
+	if err := s.PortsMap.Update(key, value, ebpf.UpdateAny); err != nil {
+		logging.AddEventLog(fmt.Sprintf("Failed to add port %s to BPF map: %v", port, err))
 		return fmt.Errorf("failed to add port to BPF map: %v", err)
 	}
 
-	logging.AddEventLog(fmt.Sprintf("Listening on port %d for service %s", port, serviceID))
-	logging.AddBPFListenerLog(serviceID, port)
+	logging.AddEventLog(fmt.Sprintf("Listening on port %s for service %s", port, serviceID))
+	logging.AddBPFListenerLog(serviceID, port.String())
 	return nil
 }
 
-func (s *BPFListener) RemovePort(port uint32) error {
+// PortHits returns the number of packets seen on an armed port since it was
+// armed
+func (s *BPFListener) PortHits(port server.PublishedPort) (uint64, error) {
+	key, err := portKey(port)
+	if err != nil {
+		return 0, err
+	}
+
+	var hits uint64
+	if err := s.PortHitsMap.Lookup(key, &hits); err != nil {
+		return 0, err
+	}
+	return hits, nil
+}
+
+func (s *BPFListener) RemovePort(port server.PublishedPort) error {
+	key, err := portKey(port)
+	if err != nil {
+		return err
+	}
+
 	// Removing the port from the local Go map.
 	serviceID, ok := portToServiceID.Load(port)
 	if !ok {
-		return fmt.Errorf("service ID %s for port %d not found in RemovePort", serviceID, port)
+		return fmt.Errorf("service ID %s for port %s not found in RemovePort", serviceID, port)
 	}
 	portToServiceID.Delete(port)
 
 	// Removing the port from the eBPF map.
-	if err := s.PortsMap.Delete(port); err != nil {
+	if err := s.PortsMap.Delete(key); err != nil {
 		return fmt.Errorf("failed to remove port from BPF map: %v", err)
 	}
 
-	logging.AddEventLog(fmt.Sprintf("Removed port %d from BPF map", port))
-	logging.RemoveBPFListenerLog(port)
+	hits, err := s.PortHits(port)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Failed to read hit count of port %s: %v", port, err))
+	}
+	s.TriggeredMap.Delete(key)
+	s.PortHitsMap.Delete(key)
+
+	logging.AddEventLog(fmt.Sprintf("Removed port %s from BPF map after %d packets", port, hits))
+	logging.RemoveBPFListenerLog(port.String())
 
 	return nil
 }
@@ -0,0 +1,49 @@
+package bpf_port_listen
+
+import (
+	"fmt"
+	"logging"
+	"server"
+	"time"
+)
+
+// How often port_hits_map is checked for wake-ups whose event was lost
+const hitScanPeriod = 2 * time.Second
+
+// scanPortHits catches armed ports that saw traffic but whose wake event never
+// arrived, because the event buffer overran. triggered_map stops the kernel
+// from sending another, so the service would otherwise stay at zero. A port
+// must show hits on two scans in a row, so events still being read aren't
+// handled twice.
+func (s *BPFListener) scanPortHits() {
+	ticker := time.NewTicker(hitScanPeriod)
+	defer ticker.Stop()
+
+	pending := make(map[server.PublishedPort]bool)
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			hit := make(map[server.PublishedPort]bool)
+			portToServiceID.Range(func(key, value interface{}) bool {
+				port := key.(server.PublishedPort)
+				if _, held := heldServices.Load(value); held {
+					return true // already waking up
+				}
+
+				hits, err := s.PortHits(port)
+				if err != nil || hits == 0 {
+					return true
+				}
+				hit[port] = true
+				if pending[port] {
+					logging.AddEventLog(fmt.Sprintf("Port %s saw %d packets without a wake event, waking service %s", port, hits, value))
+					s.wake(port)
+				}
+				return true
+			})
+			pending = hit
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package bpf_port_listen
+
+import (
+	"errors"
+	"fmt"
+	"logging"
+	"net"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+var vipToServiceID sync.Map // map[vip]serviceID
+
+// vipKey converts a VIP to its vips_map key
+func vipKey(vip string) (BPFVipKey, error) {
+	ip := net.ParseIP(vip).To16()
+	if ip == nil {
+		return BPFVipKey{}, fmt.Errorf("invalid VIP %q", vip)
+	}
+
+	var key BPFVipKey
+	copy(key.Addr[:], ip)
+	return key, nil
+}
+
+// vipAddr converts a vips_map key back to the VIP
+func vipAddr(key BPFVipKey) string {
+	return net.IP(key.Addr[:]).String()
+}
+
+// serviceVIPs returns the VIPs armed for a service
+func serviceVIPs(serviceID string) []string {
+	var vips []string
+	vipToServiceID.Range(func(key, value interface{}) bool {
+		if value.(string) == serviceID {
+			vips = append(vips, key.(string))
+		}
+		return true
+	})
+	return vips
+}
+
+// ListenOnVIP wakes the service when a process on this node connects to its
+// VIP. Services called by other services over an overlay network don't need a
+// published port to scale to zero.
+func (s *BPFListener) ListenOnVIP(vip string, serviceID string) error {
+	if s.VIPLink == nil {
+		return fmt.Errorf("VIP connect tracepoint not attached, can't listen on VIP %s", vip)
+	}
+
+	key, err := vipKey(vip)
+	if err != nil {
+		return err
+	}
+
+	vipToServiceID.Store(vip, serviceID)
+
+	if err := s.TriggeredVIPs.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to reset triggered state of VIP %s: %v", vip, err)
+	}
+	if err := s.VIPsMap.Update(key, uint32(1), ebpf.UpdateAny); err != nil {
+		logging.AddEventLog(fmt.Sprintf("Failed to add VIP %s to BPF map: %v", vip, err))
+		return fmt.Errorf("failed to add VIP to BPF map: %v", err)
+	}
+
+	logging.AddEventLog(fmt.Sprintf("Listening on VIP %s for service %s", vip, serviceID))
+	return nil
+}
+
+func (s *BPFListener) RemoveVIP(vip string) error {
+	key, err := vipKey(vip)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := vipToServiceID.Load(vip); !ok {
+		return fmt.Errorf("service ID for VIP %s not found in RemoveVIP", vip)
+	}
+	vipToServiceID.Delete(vip)
+
+	if err := s.VIPsMap.Delete(key); err != nil {
+		return fmt.Errorf("failed to remove VIP from BPF map: %v", err)
+	}
+	s.TriggeredVIPs.Delete(key)
+
+	logging.AddEventLog(fmt.Sprintf("Removed VIP %s from BPF map", vip))
+	return nil
+}
+
+// wakeVIP scales the service owning vip back up
+func (s *BPFListener) wakeVIP(vip string, port uint16) {
+	serviceID, ok := vipToServiceID.Load(vip)
+	if !ok {
+		logging.AddEventLog(fmt.Sprintf("Service ID for VIP %s removed, not waking", vip))
+		return
+	}
+	if _, held := heldServices.Load(serviceID); held {
+		return // already waking up
+	}
+	logging.AddEventLog(fmt.Sprintf("Connection to VIP %s port %d, triggering scale action for service %s", vip, port, serviceID))
+	s.wakeService(serviceID.(string))
+}
@@ -5,146 +5,219 @@ import (
 	"fmt"
 	"logging"
 	"os"
-	"path/filepath"
-	"scale"
 	"server"
 	"strconv"
 	"strings"
 	"time"
-
 )
 
 type CPUResource struct {
 	LowerUtil float64
 	UpperUtil float64
+	Smoothing SmoothingConfig
+	sampler   sampler
+	schedCPU  *schedCPU
 }
 
 type MemoryResource struct {
 	LowerLimit int64
 	UpperLimit int64
+	Smoothing  SmoothingConfig
+	sampler    sampler
 }
 
-const cgroupDir = "/sys/fs/cgroup/system.slice" // Path to the Docker cgroup directory
+// IOResource scales on block I/O throughput (MB/s) and IOPS, summed across
+// all devices in io.stat. A negative threshold disables that bound.
+type IOResource struct {
+	LowerMBps float64
+	UpperMBps float64
+	LowerIOPS float64
+	UpperIOPS float64
+	Smoothing SmoothingConfig
+	sampler   sampler
+}
+
+// ioStat holds the cumulative counters from a cgroup's io.stat file
+type ioStat struct {
+	rbytes uint64
+	wbytes uint64
+	rios   uint64
+	wios   uint64
+}
 
 func (cpu *CPUResource) Monitor(ctx context.Context, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
-	lastUsageUsec, err := readCPUUsage(containerID) // Initial read before loop
+	cpu.sampler.watch(ctx, cpu, cpu.Smoothing, containerID, collectionPeriod, swarmNodeInfo)
+}
+
+func (cpu *CPUResource) name() string {
+	return "CPU"
+}
+
+// InitBPFSampling switches CPU sampling to the sched_switch eBPF program,
+// polled every period. The utilisation compared with the thresholds is then
+// the peak seen during each collection period instead of its average, so
+// short bursts are not averaged away.
+func (cpu *CPUResource) InitBPFSampling(period time.Duration) error {
+	schedCPU, err := loadSchedCPU(period)
 	if err != nil {
-		logging.AddEventLog(fmt.Sprintf("Initial CPU usage read error for container %s: %v", containerID, err))
-		return
+		return err
 	}
 
-	logging.AddEventLog(fmt.Sprintf("Started monitoring CPU for container %s", containerID))
+	cpu.schedCPU = schedCPU
+	go schedCPU.poll(period)
 
-	ticker := time.NewTicker(collectionPeriod)
-	defer ticker.Stop()
+	logging.AddEventLog(fmt.Sprintf("Sampling CPU from sched_switch every %v", period))
+	return nil
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			currentUsageUsec, err := readCPUUsage(containerID)
-			if err != nil {
-				logging.AddEventLog(fmt.Sprintf("Error reading CPU usage for container %s: %v", containerID, err))
-				continue
-			}
-			usageDeltaUsec := currentUsageUsec - lastUsageUsec
-			cpuUtilization := (float64(usageDeltaUsec) / collectionPeriod.Seconds()) / 1e6 * 100
-
-			direction := determineScalingDirection(cpuUtilization, cpu.LowerUtil, cpu.UpperUtil)
-			if direction != "" {
-				// logging.AddScalingLog(direction)
-				logging.AddContainerLog(containerID, cpuUtilization)
-				if swarmNodeInfo.AutoscalerManager {
-					if err := scale.ScaleService(containerID, direction); err != nil {
-						logging.AddEventLog(fmt.Sprintf("Error scaling service for container %s: %v", containerID, err))
-					}
-				} else {
-					managerNode, err := server.GetManagerNode(swarmNodeInfo.OtherNodes)
-					if err != nil {
-						logging.AddEventLog(fmt.Sprintf("Error getting manager node: %v", err))
-						return
-					}
-					serviceId, err := scale.FindServiceIDFromContainer(containerID)
-
-					if err != nil {
-						logging.AddEventLog(fmt.Sprintf("error finding service ID from container: %v", err))
-						return
-					}
-
-					if err := server.SendScaleRequest(serviceId, direction, managerNode.IP); err != nil {
-						logging.AddEventLog(fmt.Sprintf("Error sending scale request to manager node: %v", err))
-					}
-				}
-			}
+// Close stops sched_switch sampling, if it was set up
+func (cpu *CPUResource) Close() {
+	if cpu.schedCPU != nil {
+		cpu.schedCPU.Close()
+	}
+}
+
+func (cpu *CPUResource) read(t *target, elapsed time.Duration) ([]float64, bool, error) {
+	if cpu.schedCPU != nil {
+		return cpu.readBPF(t)
+	}
 
-			lastUsageUsec = currentUsageUsec
+	currentUsageUsec, err := readCPUUsage(t.containerID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lastUsageUsec, ok := t.prev.(int64)
+	t.prev = currentUsageUsec
+	if !ok {
+		return nil, false, nil
+	}
+
+	usageDeltaUsec := currentUsageUsec - lastUsageUsec
+	cpuUtilization := (float64(usageDeltaUsec) / elapsed.Seconds()) / 1e6 * 100
+	return []float64{cpuUtilization}, true, nil
+}
+
+func (cpu *CPUResource) thresholds() []threshold {
+	return []threshold{{lower: cpu.LowerUtil, upper: cpu.UpperUtil}}
+}
+
+// readBPF starts tracking the container's cgroup on the first read and
+// returns its peak utilisation on every read after that.
+func (cpu *CPUResource) readBPF(t *target) ([]float64, bool, error) {
+	id, ok := t.prev.(uint64)
+	if !ok {
+		cgroup, err := getCgroupPath(t.containerID)
+		if err != nil {
+			return nil, false, err
+		}
+		if id, err = cgroupID(cgroup); err != nil {
+			return nil, false, err
 		}
+		if err := cpu.schedCPU.track(id); err != nil {
+			return nil, false, err
+		}
+		t.prev = id
+		return nil, false, nil
+	}
+
+	peak, err := cpu.schedCPU.takePeak(id)
+	if err != nil {
+		return nil, false, err
+	}
+	return []float64{peak}, true, nil
+}
+
+func (cpu *CPUResource) release(t *target) {
+	if id, ok := t.prev.(uint64); ok && cpu.schedCPU != nil {
+		cpu.schedCPU.untrack(id)
 	}
 }
 
 func (mem *MemoryResource) Monitor(ctx context.Context, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
-	ticker := time.NewTicker(collectionPeriod)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			// Context has been canceled, stop monitoring this container
-			logging.AddEventLog(fmt.Sprintf("Stopped monitoring container %s due to context cancellation", containerID))
-			return
-		case <-ticker.C:
-			// Proceed with memory usage check
-			memUsage, err := readMemoryUsage(containerID)
-			if err != nil {
-				logging.AddEventLog(fmt.Sprintf("Error reading memory usage for container %s: %v", containerID, err))
-				continue
-			}
+	mem.sampler.watch(ctx, mem, mem.Smoothing, containerID, collectionPeriod, swarmNodeInfo)
+}
 
-			direction := determineScalingDirection(float64(memUsage), float64(mem.LowerLimit), float64(mem.UpperLimit))
-
-			// Perform the scaling action if needed
-			if direction != "" {
-				logging.AddContainerLog(containerID, float64(memUsage))
-				// Assuming ScaleService handles its own context and error handling
-				if swarmNodeInfo.AutoscalerManager {
-					if err := scale.ScaleService(containerID, direction); err != nil {
-						logging.AddEventLog(fmt.Sprintf("Error scaling service for container %s: %v", containerID, err))
-					}
-				} else {
-					managerNode, err := server.GetManagerNode(swarmNodeInfo.OtherNodes)
-					if err != nil {
-						logging.AddEventLog(fmt.Sprintf("Error getting manager node: %v", err))
-						return
-					}
-					serviceId, err := scale.FindServiceIDFromContainer(containerID)
-
-					if err != nil {
-						logging.AddEventLog(fmt.Sprintf("error finding service ID from container: %v", err))
-						return
-					}
-
-					if err := server.SendScaleRequest(serviceId, direction, managerNode.IP); err != nil {
-						logging.AddEventLog(fmt.Sprintf("Error sending scale request to manager node: %v\n", err))
-					}
-				}
-			}
-		}
+func (mem *MemoryResource) name() string {
+	return "memory"
+}
+
+func (mem *MemoryResource) read(t *target, elapsed time.Duration) ([]float64, bool, error) {
+	memUsage, err := readMemoryUsage(t.containerID)
+	if err != nil {
+		return nil, false, err
 	}
+	return []float64{float64(memUsage)}, true, nil
+}
+
+func (mem *MemoryResource) thresholds() []threshold {
+	return []threshold{{lower: float64(mem.LowerLimit), upper: float64(mem.UpperLimit)}}
+}
+
+func (io *IOResource) Monitor(ctx context.Context, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
+	io.sampler.watch(ctx, io, io.Smoothing, containerID, collectionPeriod, swarmNodeInfo)
+}
+
+func (io *IOResource) name() string {
+	return "I/O"
 }
 
-// determineScalingDirection decides the scaling direction based on usage and thresholds.
-func determineScalingDirection(currentValue float64, lowerThreshold, upperThreshold float64) string {
-	if currentValue > upperThreshold {
-		return "over"
-	} else if currentValue < lowerThreshold {
-		return "under"
+func (io *IOResource) read(t *target, elapsed time.Duration) ([]float64, bool, error) {
+	currentStat, err := readIOStat(t.containerID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lastStat, ok := t.prev.(ioStat)
+	t.prev = currentStat
+	if !ok {
+		return nil, false, nil
+	}
+
+	mbps, iops, ok := ioRates(lastStat, currentStat, elapsed)
+	if !ok {
+		return nil, false, nil
+	}
+	return []float64{mbps, iops}, true, nil
+}
+
+func (io *IOResource) thresholds() []threshold {
+	return []threshold{
+		{lower: io.LowerMBps, upper: io.UpperMBps},
+		{lower: io.LowerIOPS, upper: io.UpperIOPS},
 	}
-	return "" // No action needed if within thresholds
+}
+
+// ioRates returns the combined read/write throughput in MB/s and the combined
+// IOPS between two io.stat samples taken period apart. The counters go down
+// when a device disappears from io.stat or the cgroup is recreated, and ok is
+// false for such a pair, which would otherwise wrap around to a huge rate.
+func ioRates(last, current ioStat, period time.Duration) (mbps float64, iops float64, ok bool) {
+	lastBytes, currentBytes := last.rbytes+last.wbytes, current.rbytes+current.wbytes
+	lastIOs, currentIOs := last.rios+last.wios, current.rios+current.wios
+	if currentBytes < lastBytes || currentIOs < lastIOs {
+		return 0, 0, false
+	}
+
+	seconds := period.Seconds()
+	return float64(currentBytes-lastBytes) / seconds / (1024 * 1024), float64(currentIOs-lastIOs) / seconds, true
 }
 
 func readMemoryUsage(containerID string) (int64, error) {
-	memCurrentPath := filepath.Join(cgroupDir, fmt.Sprintf("docker-%s.scope/memory.current", containerID))
+	cgroup, err := getCgroupPath(containerID)
+	if err != nil {
+		return 0, err
+	}
+
+	// cgroup v2 exposes memory.current, v1 memory.usage_in_bytes
+	fileName := "memory.current"
+	if cgroup.unified == "" {
+		fileName = "memory.usage_in_bytes"
+	}
+	memCurrentPath, err := cgroup.file("memory", fileName)
+	if err != nil {
+		return 0, err
+	}
 	content, err := os.ReadFile(memCurrentPath)
 	if err != nil {
 		return 0, err
@@ -162,7 +235,19 @@ func readMemoryUsage(containerID string) (int64, error) {
 }
 
 func readCPUUsage(containerID string) (int64, error) {
-	cpuStatPath := filepath.Join(cgroupDir, fmt.Sprintf("docker-%s.scope/cpu.stat", containerID))
+	cgroup, err := getCgroupPath(containerID)
+	if err != nil {
+		return 0, err
+	}
+
+	if cgroup.unified == "" {
+		return readCPUUsageV1(cgroup)
+	}
+
+	cpuStatPath, err := cgroup.file("cpu", "cpu.stat")
+	if err != nil {
+		return 0, err
+	}
 	content, err := os.ReadFile(cpuStatPath)
 	if err != nil {
 		return 0, err
@@ -184,3 +269,131 @@ func readCPUUsage(containerID string) (int64, error) {
 
 	return 0, fmt.Errorf("usage_usec not found in cpu.stat for container %s", containerID)
 }
+
+// readCPUUsageV1 reads cpuacct.usage, which cgroup v1 reports in nanoseconds
+func readCPUUsageV1(cgroup *cgroupPath) (int64, error) {
+	usagePath, err := cgroup.file("cpuacct", "cpuacct.usage")
+	if err != nil {
+		return 0, err
+	}
+	content, err := os.ReadFile(usagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	usageNsec, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return usageNsec / 1000, nil
+}
+
+func readIOStat(containerID string) (ioStat, error) {
+	cgroup, err := getCgroupPath(containerID)
+	if err != nil {
+		return ioStat{}, err
+	}
+
+	if cgroup.unified == "" {
+		return readBlkioStat(cgroup)
+	}
+
+	ioStatPath, err := cgroup.file("io", "io.stat")
+	if err != nil {
+		return ioStat{}, err
+	}
+	content, err := os.ReadFile(ioStatPath)
+	if err != nil {
+		return ioStat{}, err
+	}
+
+	return parseIOStat(string(content))
+}
+
+// parseIOStat sums the per-device counters of an io.stat file, e.g.
+// "8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0"
+func parseIOStat(content string) (ioStat, error) {
+	var stat ioStat
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// First field is the MAJ:MIN device number
+		for _, field := range fields[1:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			var counter *uint64
+			switch key {
+			case "rbytes":
+				counter = &stat.rbytes
+			case "wbytes":
+				counter = &stat.wbytes
+			case "rios":
+				counter = &stat.rios
+			case "wios":
+				counter = &stat.wios
+			default:
+				continue // e.g. io.latency's depth=max
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return ioStat{}, fmt.Errorf("parsing %s in io.stat: %w", key, err)
+			}
+			*counter += n
+		}
+	}
+	return stat, nil
+}
+
+// readBlkioStat builds the same counters from the cgroup v1 blkio controller
+func readBlkioStat(cgroup *cgroupPath) (ioStat, error) {
+	var stat ioStat
+
+	bytesPath, err := cgroup.file("blkio", "blkio.throttle.io_service_bytes_recursive")
+	if err != nil {
+		return ioStat{}, err
+	}
+	if stat.rbytes, stat.wbytes, err = readBlkioFile(bytesPath); err != nil {
+		return ioStat{}, err
+	}
+
+	iosPath, err := cgroup.file("blkio", "blkio.throttle.io_serviced_recursive")
+	if err != nil {
+		return ioStat{}, err
+	}
+	if stat.rios, stat.wios, err = readBlkioFile(iosPath); err != nil {
+		return ioStat{}, err
+	}
+
+	return stat, nil
+}
+
+// readBlkioFile sums the Read and Write rows of a blkio file, e.g. "8:0 Read 4096"
+func readBlkioFile(path string) (uint64, uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var read, write uint64
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		switch fields[1] {
+		case "Read":
+			read += n
+		case "Write":
+			write += n
+		}
+	}
+	return read, write, nil
+}
@@ -0,0 +1,113 @@
+package cgroup_monitoring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseIOStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    ioStat
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			content: "",
+		},
+		{
+			name:    "one device",
+			content: "8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0\n",
+			want:    ioStat{rbytes: 1459200, wbytes: 314773504, rios: 192, wios: 353},
+		},
+		{
+			name: "devices summed",
+			content: "8:16 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n" +
+				"8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0\n",
+			want: ioStat{rbytes: 1463296, wbytes: 314781696, rios: 193, wios: 355},
+		},
+		{
+			name:    "io.latency and io.cost fields",
+			content: "259:0 rbytes=278528 wbytes=0 rios=34 wios=0 dbytes=0 dios=0 use_delay=0 delay_nsec=0 depth=max avg_lat=0 win=0 cost.vrate=100.00 cost.usage=1432 cost.wait=0 cost.indebt=0 cost.indelay=0\n",
+			want:    ioStat{rbytes: 278528, rios: 34},
+		},
+		{
+			name:    "field without value",
+			content: "8:0 rbytes=512 flag wios=1\n",
+			want:    ioStat{rbytes: 512, wios: 1},
+		},
+		{
+			name:    "device without counters",
+			content: "8:0\n",
+		},
+		{
+			name:    "non-numeric counter",
+			content: "8:0 rbytes=max wbytes=0 rios=0 wios=0\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIOStat(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIOStat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseIOStat() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIORates(t *testing.T) {
+	const mb = 1024 * 1024
+
+	tests := []struct {
+		name          string
+		last, current ioStat
+		period        time.Duration
+		wantMBps      float64
+		wantIOPS      float64
+		wantOK        bool
+	}{
+		{
+			name:    "idle",
+			last:    ioStat{rbytes: mb, rios: 10},
+			current: ioStat{rbytes: mb, rios: 10},
+			period:  time.Second,
+			wantOK:  true,
+		},
+		{
+			name:     "reads and writes",
+			last:     ioStat{rbytes: mb, wbytes: mb, rios: 10, wios: 10},
+			current:  ioStat{rbytes: 3 * mb, wbytes: 5 * mb, rios: 30, wios: 50},
+			period:   2 * time.Second,
+			wantMBps: 3,
+			wantIOPS: 30,
+			wantOK:   true,
+		},
+		{
+			name:    "bytes went down",
+			last:    ioStat{rbytes: 2 * mb, rios: 10},
+			current: ioStat{rbytes: mb, rios: 20},
+			period:  time.Second,
+		},
+		{
+			name:    "IOs went down",
+			last:    ioStat{rbytes: mb, rios: 20},
+			current: ioStat{rbytes: 2 * mb, rios: 10},
+			period:  time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mbps, iops, ok := ioRates(tt.last, tt.current, tt.period)
+			if ok != tt.wantOK || mbps != tt.wantMBps || iops != tt.wantIOPS {
+				t.Errorf("ioRates() = %v, %v, %v, want %v, %v, %v", mbps, iops, ok, tt.wantMBps, tt.wantIOPS, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package cgroup_monitoring
+
+import (
+	"fmt"
+	"logging"
+	"os"
+	"path/filepath"
+	"scale"
+	"strings"
+	"sync"
+)
+
+// cgroupPath locates a container's cgroup on disk. On cgroup v2 hosts only
+// unified is set, on cgroup v1 hosts each controller has its own directory.
+type cgroupPath struct {
+	unified     string
+	controllers map[string]string
+}
+
+var (
+	cgroupPaths sync.Map // map[containerID]*cgroupPath
+	cgroupIDs   sync.Map // map[containerID]uint64, for callers outside this package
+)
+
+// Layouts tried when /proc/<pid>/cgroup can't be used, relative to the mount root
+var fallbackLayouts = []string{
+	"system.slice/docker-%s.scope", // systemd driver, default parent
+	"docker/%s",                    // cgroupfs driver, default parent
+}
+
+// cgroupMountRoot returns where the host cgroup filesystem is mounted,
+// preferring a /host_sys mount when the autoscaler runs inside a container.
+func cgroupMountRoot() string {
+	if _, err := os.Stat("/host_sys/fs/cgroup"); err == nil {
+		return "/host_sys/fs/cgroup"
+	}
+	return "/sys/fs/cgroup"
+}
+
+// isUnifiedHierarchy reports whether root is a pure cgroup v2 mount
+func isUnifiedHierarchy(root string) bool {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	return err == nil
+}
+
+// getCgroupPath returns the cached cgroup location for a container,
+// resolving it on first use.
+func getCgroupPath(containerID string) (*cgroupPath, error) {
+	if cached, ok := cgroupPaths.Load(containerID); ok {
+		return cached.(*cgroupPath), nil
+	}
+
+	cgroup, err := resolveCgroupPath(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	cgroupPaths.Store(containerID, cgroup)
+	return cgroup, nil
+}
+
+// forgetCgroupPath drops the cached cgroup location once a container stops
+func forgetCgroupPath(containerID string) {
+	cgroupPaths.Delete(containerID)
+}
+
+// resolveCgroupPath reads /proc/<pid>/cgroup of the container's init process,
+// which works for any cgroup driver, parent or rootless setup. The well-known
+// Docker layouts are only used if that fails.
+func resolveCgroupPath(containerID string) (*cgroupPath, error) {
+	root := cgroupMountRoot()
+	unified := isUnifiedHierarchy(root)
+
+	pid, err := scale.GetContainerPid(containerID)
+	if err == nil {
+		content, readErr := os.ReadFile(fmt.Sprintf("%s/%d/cgroup", scale.ProcRoot(), pid))
+		if readErr == nil {
+			cgroup, parseErr := parseProcCgroup(root, unified, string(content))
+			if parseErr == nil {
+				logging.AddEventLog(fmt.Sprintf("Resolved cgroup for container %s from PID %d", containerID, pid))
+				return cgroup, nil
+			}
+			err = parseErr
+		} else {
+			err = readErr
+		}
+	}
+	logging.AddEventLog(fmt.Sprintf("Falling back to default cgroup layouts for container %s: %v", containerID, err))
+
+	for _, layout := range fallbackLayouts {
+		relative := fmt.Sprintf(layout, containerID)
+		if unified {
+			dir := filepath.Join(root, relative)
+			if dirExists(dir) {
+				return &cgroupPath{unified: dir}, nil
+			}
+			continue
+		}
+
+		controllers := make(map[string]string)
+		for _, controller := range []string{"cpuacct", "memory", "blkio"} {
+			dir := filepath.Join(root, controller, relative)
+			if dirExists(dir) {
+				controllers[controller] = dir
+			}
+		}
+		if len(controllers) > 0 {
+			return &cgroupPath{controllers: controllers}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no cgroup found for container %s under %s", containerID, root)
+}
+
+// CgroupID returns the ID BPF programs see for the container's cgroup. It is
+// cached until ForgetCgroupID is called once the container stops.
+func CgroupID(containerID string) (uint64, error) {
+	if cached, ok := cgroupIDs.Load(containerID); ok {
+		return cached.(uint64), nil
+	}
+
+	cgroup, err := resolveCgroupPath(containerID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := cgroupID(cgroup)
+	if err != nil {
+		return 0, err
+	}
+
+	cgroupIDs.Store(containerID, id)
+	return id, nil
+}
+
+// ForgetCgroupID drops the cached cgroup ID of a container
+func ForgetCgroupID(containerID string) {
+	cgroupIDs.Delete(containerID)
+}
+
+// parseProcCgroup maps the entries of a /proc/<pid>/cgroup file onto the
+// mount root. Lines have the form "hierarchy-ID:controller-list:path", where
+// cgroup v2 uses "0::path".
+func parseProcCgroup(root string, unified bool, content string) (*cgroupPath, error) {
+	cgroup := &cgroupPath{controllers: make(map[string]string)}
+
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		hierarchyID, controllerList, path := parts[0], parts[1], parts[2]
+
+		// Paths outside our own cgroup namespace are reported relative to
+		// its root ("/../docker-<id>.scope"), which isn't known here, so the
+		// caller falls back to the default layouts for them.
+		if outsideNamespace(path) {
+			return nil, fmt.Errorf("cgroup path %s is outside the autoscaler's cgroup namespace", path)
+		}
+		path = strings.TrimPrefix(filepath.Clean(path), "/")
+
+		if unified {
+			if hierarchyID == "0" && controllerList == "" {
+				dir := filepath.Join(root, path)
+				if !dirExists(dir) {
+					return nil, fmt.Errorf("cgroup directory %s does not exist", dir)
+				}
+				cgroup.unified = dir
+				return cgroup, nil
+			}
+			continue
+		}
+
+		for _, controller := range strings.Split(controllerList, ",") {
+			if controller == "" || strings.HasPrefix(controller, "name=") {
+				continue
+			}
+			// Co-mounted controllers (cpu,cpuacct) are usually symlinked
+			// individually, but fall back to the combined mount name.
+			dir := filepath.Join(root, controller, path)
+			if !dirExists(dir) {
+				dir = filepath.Join(root, controllerList, path)
+			}
+			if dirExists(dir) {
+				cgroup.controllers[controller] = dir
+			}
+		}
+	}
+
+	if unified {
+		return nil, fmt.Errorf("no cgroup v2 entry found")
+	}
+	if len(cgroup.controllers) == 0 {
+		return nil, fmt.Errorf("no cgroup v1 controllers found")
+	}
+	return cgroup, nil
+}
+
+// outsideNamespace reports whether a /proc/<pid>/cgroup path climbs above the
+// reader's cgroup namespace root. filepath.Clean would silently drop the "..".
+func outsideNamespace(path string) bool {
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// file returns the path of a cgroup interface file. v1 files are looked up in
+// the directory of the controller that owns them.
+func (cgroup *cgroupPath) file(controller, name string) (string, error) {
+	if cgroup.unified != "" {
+		return filepath.Join(cgroup.unified, name), nil
+	}
+
+	dir, ok := cgroup.controllers[controller]
+	if !ok {
+		return "", fmt.Errorf("cgroup v1 controller %s not mounted", controller)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
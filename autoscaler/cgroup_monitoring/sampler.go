@@ -0,0 +1,291 @@
+package cgroup_monitoring
+
+import (
+	"context"
+	"fmt"
+	"logging"
+	"scale"
+	"server"
+	"sync"
+	"time"
+)
+
+// metric is implemented by each cgroup resource so a single sampler can read
+// every container on the node.
+type metric interface {
+	name() string
+	// read returns the values for the period since the previous read, e.g.
+	// [utilisation] or [MB/s, IOPS]. ok is false while a counter based metric
+	// only has its first reading.
+	read(t *target, elapsed time.Duration) (values []float64, ok bool, err error)
+	// thresholds returns the bounds for each value returned by read
+	thresholds() []threshold
+}
+
+// releaser is implemented by metrics that hold per-container state outside
+// the target, such as BPF map entries.
+type releaser interface {
+	release(t *target)
+}
+
+type threshold struct {
+	lower float64
+	upper float64
+}
+
+// target is a container registered with the sampler. The service ID is looked
+// up once on registration rather than every time the container needs scaling.
+type target struct {
+	containerID string
+	serviceID   string
+	lastRead    time.Time
+	prev        interface{}     // previous raw counter reading, owned by the metric
+	smoothing   SmoothingConfig // node config with the service's labels applied
+	policy      *policy
+	labelsRead  time.Time // when smoothing was last synced with the labels
+}
+
+type sample struct {
+	target *target
+	values []float64
+}
+
+// sampler reads every monitored cgroup of one resource on a single tick
+// aligned to the collection period, and evaluates the results as one batch.
+type sampler struct {
+	once      sync.Once
+	mu        sync.Mutex
+	targets   map[string]*target
+	removed   []*target       // unwatched, released by the sampling goroutine
+	updated   map[string]bool // services whose labels changed, by ID
+	metric    metric
+	smoothing SmoothingConfig
+	period    time.Duration
+	nodeInfo  *server.SwarmNodeInfo
+}
+
+// watch registers the container with the sampler until ctx is cancelled,
+// starting the sampling loop on first use. It doesn't block, a cancelled
+// container is dropped on the next tick.
+func (s *sampler) watch(ctx context.Context, m metric, smoothing SmoothingConfig, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
+	s.once.Do(func() {
+		s.targets = make(map[string]*target)
+		s.updated = make(map[string]bool)
+		scale.OnServiceUpdate(s.serviceUpdated)
+		s.metric = m
+		s.smoothing = smoothing
+		s.period = collectionPeriod
+		s.nodeInfo = swarmNodeInfo
+		go s.run()
+	})
+
+	labels, err := scale.GetContainerLabels(containerID)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Error inspecting container %s: %v", containerID, err))
+		return
+	}
+	serviceID, ok := labels["com.docker.swarm.service.id"]
+	if !ok {
+		logging.AddEventLog(fmt.Sprintf("Service ID label not found on container %s", containerID))
+		return
+	}
+
+	t := &target{
+		containerID: containerID,
+		serviceID:   serviceID,
+	}
+	s.syncPolicy(t)
+
+	// Initial read before registering, this primes counter based metrics
+	if _, _, err := m.read(t, 0); err != nil {
+		logging.AddEventLog(fmt.Sprintf("Initial %s read error for container %s: %v", m.name(), containerID, err))
+		forgetCgroupPath(containerID)
+		return
+	}
+	t.lastRead = time.Now()
+
+	s.mu.Lock()
+	s.targets[containerID] = t
+	s.mu.Unlock()
+
+	logging.AddEventLog(fmt.Sprintf("Started monitoring %s for container %s", m.name(), containerID))
+
+	context.AfterFunc(ctx, func() { s.unwatch(t) })
+}
+
+// serviceUpdated marks the targets of a service to have their labels read
+// again on the next tick
+func (s *sampler) serviceUpdated(serviceID string) {
+	s.mu.Lock()
+	s.updated[serviceID] = true
+	s.mu.Unlock()
+}
+
+// syncPolicy applies the current labels of the container and its service to
+// its smoothing config. Service labels can change while it runs, the policy
+// starts over when they do.
+func (s *sampler) syncPolicy(t *target) {
+	t.labelsRead = time.Now()
+	labels, err := scale.GetScalingLabels(t.containerID, t.serviceID, s.nodeInfo.AutoscalerManager)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Error reading labels of container %s: %v", t.containerID, err))
+		if t.policy == nil {
+			t.policy = newPolicy(s.smoothing)
+		}
+		return
+	}
+
+	smoothing := s.smoothing.withLabels(labels)
+	if t.policy != nil && smoothing == t.smoothing {
+		return
+	}
+	if t.policy != nil {
+		logging.AddEventLog(fmt.Sprintf("Smoothing labels of container %s changed, resetting its policy", t.containerID))
+	}
+	t.smoothing = smoothing
+	t.policy = newPolicy(smoothing)
+}
+
+// unwatch removes a target from sampling. Its state is released by the
+// sampling goroutine, since a tick in progress may still be reading it.
+func (s *sampler) unwatch(t *target) {
+	s.mu.Lock()
+	if s.targets[t.containerID] == t {
+		delete(s.targets, t.containerID)
+	}
+	s.removed = append(s.removed, t)
+	s.mu.Unlock()
+}
+
+// release drops the state of an unwatched target
+func (s *sampler) release(t *target) {
+	if r, ok := s.metric.(releaser); ok {
+		r.release(t)
+	}
+	forgetCgroupPath(t.containerID)
+
+	logging.AddEventLog(fmt.Sprintf("Stopped monitoring container %s due to context cancellation", t.containerID))
+}
+
+// run samples on wall-clock multiples of the collection period so readings
+// across containers (and nodes) line up.
+func (s *sampler) run() {
+	next := time.Now().Truncate(s.period).Add(s.period)
+	for {
+		time.Sleep(time.Until(next))
+		s.tick()
+
+		next = next.Add(s.period)
+		if now := time.Now(); next.Before(now) {
+			// A slow tick overran the period, skip to the next aligned tick
+			next = now.Truncate(s.period).Add(s.period)
+		}
+	}
+}
+
+func (s *sampler) tick() {
+	s.mu.Lock()
+	removed := s.removed
+	s.removed = nil
+	updated := s.updated
+	s.updated = make(map[string]bool)
+	targets := make([]*target, 0, len(s.targets))
+	for _, t := range s.targets {
+		targets = append(targets, t)
+	}
+	s.mu.Unlock()
+
+	// No read of these is in progress, the previous tick ran on this goroutine
+	for _, t := range removed {
+		s.release(t)
+	}
+
+	batch := make([]sample, 0, len(targets))
+	for _, t := range targets {
+		// Labels are only read again when the service changed, or as a
+		// fallback for missed events once the cached labels expired
+		if updated[t.serviceID] || time.Since(t.labelsRead) > scale.ServiceLabelsTTL {
+			s.syncPolicy(t)
+		}
+
+		now := time.Now()
+		values, ok, err := s.metric.read(t, now.Sub(t.lastRead))
+		if err != nil {
+			logging.AddEventLog(fmt.Sprintf("Error reading %s for container %s: %v", s.metric.name(), t.containerID, err))
+			continue
+		}
+		t.lastRead = now
+		if ok {
+			batch = append(batch, sample{target: t, values: values})
+		}
+	}
+
+	s.evaluate(batch)
+}
+
+// evaluate runs every sample through its container's policy and sends at most
+// one scaling request per service for the batch. Scaling up wins if replicas
+// disagree.
+func (s *sampler) evaluate(batch []sample) {
+	decisions := make(map[string]string)
+	for _, smp := range batch {
+		smoothed, direction := smp.target.policy.evaluate(smp.values, s.metric.thresholds())
+		if direction == "" {
+			continue
+		}
+
+		logging.AddContainerLog(smp.target.containerID, smoothed[0])
+		if decisions[smp.target.serviceID] != "over" {
+			decisions[smp.target.serviceID] = direction
+		}
+	}
+
+	if len(decisions) == 0 {
+		return
+	}
+
+	if s.nodeInfo.AutoscalerManager {
+		for serviceID, direction := range decisions {
+			if err := scale.ChangeServiceReplicas(serviceID, direction); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Error scaling service %s: %v", serviceID, err))
+			}
+		}
+		return
+	}
+
+	managerNode, err := server.GetManagerNode(s.nodeInfo.OtherNodes)
+	if err != nil {
+		logging.AddEventLog(fmt.Sprintf("Error getting manager node: %v", err))
+		return
+	}
+	for serviceID, direction := range decisions {
+		if err := server.SendScaleRequest(serviceID, direction, managerNode.IP); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Error sending scale request to manager node: %v", err))
+		}
+	}
+}
+
+// determineScalingDirection decides the scaling direction based on usage and
+// thresholds. Any value above its upper bound scales up, but every value with
+// a lower bound must be below it before scaling down. Negative bounds are
+// disabled.
+func determineScalingDirection(values []float64, thresholds []threshold) string {
+	under, hasLower := true, false
+	for i, value := range values {
+		bounds := thresholds[i]
+		if bounds.upper >= 0 && value > bounds.upper {
+			return "over"
+		}
+		if bounds.lower >= 0 {
+			hasLower = true
+			if value >= bounds.lower {
+				under = false
+			}
+		}
+	}
+
+	if hasLower && under {
+		return "under"
+	}
+	return "" // No action needed if within thresholds
+}
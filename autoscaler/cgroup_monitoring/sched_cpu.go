@@ -0,0 +1,302 @@
+package cgroup_monitoring
+
+import (
+	"errors"
+	"fmt"
+	"logging"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+)
+
+// schedCPU accounts on-CPU time per cgroup from the sched_switch tracepoint,
+// so CPU usage can be read far more often than cpu.stat is polled. A task
+// that keeps running is never switched out, so a per-CPU clock tick accounts
+// its time too.
+type schedCPU struct {
+	cpuTimeMap    *ebpf.Map // cgroup ID -> total on-CPU nanoseconds
+	lastSwitchMap *ebpf.Map // per-CPU timestamp of the previous switch or tick
+	program       *ebpf.Program
+	link          link.Link
+	tickProgram   *ebpf.Program
+	tickEvents    []int // per-CPU perf event FDs running tickProgram
+
+	mu     sync.Mutex
+	bursts map[uint64]*burst // cgroup ID -> utilisation windows since last read
+
+	stop chan struct{}
+	done chan struct{} // closed when poll returns
+}
+
+// burst tracks the high resolution utilisation of one cgroup between two
+// reads by the sampler.
+type burst struct {
+	primed   bool
+	lastNs   uint64
+	lastTime time.Time
+	peak     float64
+}
+
+// loadSchedCPU loads and attaches the accounting programs, ticking every
+// period. The programs are small enough to assemble here, which keeps them
+// independent of the clang build.
+func loadSchedCPU(period time.Duration) (*schedCPU, error) {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("failed to remove memlock limit: %v", err)
+	}
+
+	lastSwitchMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "last_switch",
+		Type:       ebpf.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating last_switch map: %v", err)
+	}
+
+	cpuTimeMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "cpu_time_map",
+		Type:       ebpf.Hash,
+		KeySize:    8,
+		ValueSize:  8,
+		MaxEntries: 4096,
+	})
+	if err != nil {
+		lastSwitchMap.Close()
+		return nil, fmt.Errorf("creating cpu_time_map: %v", err)
+	}
+
+	s := &schedCPU{
+		cpuTimeMap:    cpuTimeMap,
+		lastSwitchMap: lastSwitchMap,
+		bursts:        make(map[uint64]*burst),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	s.program, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "sched_cpu",
+		Type:         ebpf.TracePoint,
+		Instructions: accountingInsns(lastSwitchMap, cpuTimeMap),
+		License:      "GPL",
+	})
+	if err != nil {
+		s.closeObjects()
+		return nil, fmt.Errorf("loading sched_switch program: %v", err)
+	}
+
+	s.tickProgram, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "sched_cpu_tick",
+		Type:         ebpf.PerfEvent,
+		Instructions: accountingInsns(lastSwitchMap, cpuTimeMap),
+		License:      "GPL",
+	})
+	if err != nil {
+		s.closeObjects()
+		return nil, fmt.Errorf("loading CPU clock program: %v", err)
+	}
+
+	if s.link, err = link.Tracepoint("sched", "sched_switch", s.program, nil); err != nil {
+		s.closeObjects()
+		return nil, fmt.Errorf("attaching sched_switch tracepoint: %v", err)
+	}
+
+	if err := s.attachTicks(period); err != nil {
+		s.closeObjects()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// accountingInsns charges the time since the previous switch or tick on this
+// CPU to the cgroup of the current task. sched_switch runs in the context of
+// the task being switched out, and the clock tick in that of the task it
+// interrupted.
+func accountingInsns(lastSwitchMap, cpuTimeMap *ebpf.Map) asm.Instructions {
+	return asm.Instructions{
+		// last = last_switch[0]
+		asm.StoreImm(asm.RFP, -4, 0, asm.Word),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.LoadMapPtr(asm.R1, lastSwitchMap.FD()),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.Mov.Reg(asm.R7, asm.R0),
+
+		// delta = now - *last; *last = now
+		asm.FnKtimeGetNs.Call(),
+		asm.Mov.Reg(asm.R8, asm.R0),
+		asm.LoadMem(asm.R9, asm.R7, 0, asm.DWord),
+		asm.StoreMem(asm.R7, 0, asm.R8, asm.DWord),
+		asm.JEq.Imm(asm.R9, 0, "exit"),
+		asm.Sub.Reg(asm.R8, asm.R9),
+
+		// cpu_time_map[cgroup] += delta, only for tracked cgroups
+		asm.FnGetCurrentCgroupId.Call(),
+		asm.StoreMem(asm.RFP, -16, asm.R0, asm.DWord),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.LoadMapPtr(asm.R1, cpuTimeMap.FD()),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.StoreXAdd(asm.R0, asm.R8, asm.DWord),
+
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	}
+}
+
+// attachTicks runs the tick program from a CPU clock perf event on every CPU,
+// so each poll sees at most one period of a running task's time unaccounted.
+func (s *schedCPU) attachTicks(period time.Duration) error {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return fmt.Errorf("counting CPUs: %v", err)
+	}
+
+	attr := unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Sample: uint64(period.Nanoseconds()),
+	}
+	for cpu := 0; cpu < cpus; cpu++ {
+		fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+		if errors.Is(err, unix.ENODEV) {
+			continue // possible but offline
+		}
+		if err != nil {
+			return fmt.Errorf("opening CPU clock event on CPU %d: %v", cpu, err)
+		}
+		s.tickEvents = append(s.tickEvents, fd)
+
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, s.tickProgram.FD()); err != nil {
+			return fmt.Errorf("attaching CPU clock program on CPU %d: %v", cpu, err)
+		}
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			return fmt.Errorf("enabling CPU clock event on CPU %d: %v", cpu, err)
+		}
+	}
+	return nil
+}
+
+// Close stops polling and detaches the programs
+func (s *schedCPU) Close() {
+	close(s.stop)
+	<-s.done
+	s.closeObjects()
+}
+
+func (s *schedCPU) closeObjects() {
+	for _, fd := range s.tickEvents {
+		unix.Close(fd)
+	}
+	if s.link != nil {
+		s.link.Close()
+	}
+	if s.tickProgram != nil {
+		s.tickProgram.Close()
+	}
+	if s.program != nil {
+		s.program.Close()
+	}
+	s.cpuTimeMap.Close()
+	s.lastSwitchMap.Close()
+}
+
+// cgroupID returns the ID the kernel reports from bpf_get_current_cgroup_id,
+// which is the inode number of the cgroup v2 directory.
+func cgroupID(cgroup *cgroupPath) (uint64, error) {
+	if cgroup.unified == "" {
+		return 0, errors.New("BPF cgroup IDs require cgroup v2")
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Stat(cgroup.unified, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Ino, nil
+}
+
+// track starts accounting CPU time for a cgroup
+func (s *schedCPU) track(id uint64) error {
+	if err := s.cpuTimeMap.Update(id, uint64(0), ebpf.UpdateNoExist); err != nil && !errors.Is(err, ebpf.ErrKeyExist) {
+		return fmt.Errorf("adding cgroup %d to cpu_time_map: %v", id, err)
+	}
+
+	s.mu.Lock()
+	s.bursts[id] = &burst{lastTime: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *schedCPU) untrack(id uint64) {
+	s.mu.Lock()
+	delete(s.bursts, id)
+	s.mu.Unlock()
+
+	if err := s.cpuTimeMap.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		logging.AddEventLog(fmt.Sprintf("Failed to delete cgroup %d from cpu_time_map: %v", id, err))
+	}
+}
+
+// poll reads the on-CPU time of every tracked cgroup each period and keeps
+// the highest utilisation seen since the sampler last asked for it, until
+// Close is called.
+func (s *schedCPU) poll(period time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		s.mu.Lock()
+		for id, b := range s.bursts {
+			var totalNs uint64
+			if err := s.cpuTimeMap.Lookup(id, &totalNs); err != nil {
+				continue
+			}
+
+			now := time.Now()
+			if b.primed {
+				utilisation := float64(totalNs-b.lastNs) / float64(now.Sub(b.lastTime).Nanoseconds()) * 100
+				if utilisation > b.peak {
+					b.peak = utilisation
+				}
+			}
+			b.primed = true
+			b.lastNs = totalNs
+			b.lastTime = now
+		}
+		s.mu.Unlock()
+	}
+}
+
+// takePeak returns the peak utilisation of a cgroup since the previous call
+func (s *schedCPU) takePeak(id uint64) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.bursts[id]
+	if !ok {
+		return 0, fmt.Errorf("cgroup %d is not tracked", id)
+	}
+	peak := b.peak
+	b.peak = 0
+	return peak, nil
+}
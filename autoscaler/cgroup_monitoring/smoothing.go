@@ -0,0 +1,206 @@
+package cgroup_monitoring
+
+import (
+	"fmt"
+	"logging"
+	"sort"
+	"strconv"
+)
+
+// SmoothingConfig controls how raw samples are filtered before they are
+// compared with the thresholds. Services can override any field with
+// container or service labels, e.g. autoscaler.smoothing=ewma.
+type SmoothingConfig struct {
+	Method     string  `yaml:"method"`     // none, ewma, mean or median
+	Alpha      float64 `yaml:"alpha"`      // weight of the newest sample for ewma
+	Window     int     `yaml:"window"`     // number of samples for mean and median
+	Breaches   int     `yaml:"breaches"`   // consecutive breaches needed before scaling
+	Hysteresis float64 `yaml:"hysteresis"` // fraction of a threshold used as a dead band
+}
+
+// Labels that override the node-wide smoothing config
+const (
+	smoothingLabel  = "autoscaler.smoothing"
+	alphaLabel      = "autoscaler.smoothingAlpha"
+	windowLabel     = "autoscaler.smoothingWindow"
+	breachesLabel   = "autoscaler.breaches"
+	hysteresisLabel = "autoscaler.hysteresis"
+)
+
+// withLabels returns a copy of the config with any per-service overrides applied
+func (config SmoothingConfig) withLabels(labels map[string]string) SmoothingConfig {
+	if method, ok := labels[smoothingLabel]; ok {
+		config.Method = method
+	}
+	parseFloat := func(label string, field *float64) {
+		if value, ok := labels[label]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				*field = parsed
+			} else {
+				logging.AddEventLog(fmt.Sprintf("Ignoring invalid %s label %q: %v", label, value, err))
+			}
+		}
+	}
+	parseInt := func(label string, field *int) {
+		if value, ok := labels[label]; ok {
+			if parsed, err := strconv.Atoi(value); err == nil {
+				*field = parsed
+			} else {
+				logging.AddEventLog(fmt.Sprintf("Ignoring invalid %s label %q: %v", label, value, err))
+			}
+		}
+	}
+	parseFloat(alphaLabel, &config.Alpha)
+	parseInt(windowLabel, &config.Window)
+	parseInt(breachesLabel, &config.Breaches)
+	parseFloat(hysteresisLabel, &config.Hysteresis)
+
+	return config
+}
+
+// policy holds the smoothing and hysteresis state of a single container
+type policy struct {
+	config        SmoothingConfig
+	windows       [][]float64 // recent samples per value, for mean and median
+	averages      []float64   // running ewma per value
+	breaches      int         // consecutive samples breaching in breachDir
+	breachDir     string
+	lastDirection string // last direction scaled in, used for hysteresis
+}
+
+func newPolicy(config SmoothingConfig) *policy {
+	switch config.Method {
+	case "", "none", "ewma", "mean", "median":
+	default:
+		logging.AddEventLog(fmt.Sprintf("Unknown smoothing method %q, using raw samples", config.Method))
+		config.Method = "none"
+	}
+	if config.Alpha <= 0 || config.Alpha > 1 {
+		config.Alpha = 0.5
+	}
+	if config.Window < 1 {
+		config.Window = 1
+	}
+	if config.Breaches < 1 {
+		config.Breaches = 1
+	}
+	if config.Hysteresis < 0 {
+		config.Hysteresis = 0
+	}
+	return &policy{config: config}
+}
+
+// evaluate smooths the sample and returns the direction to scale in, if any
+func (p *policy) evaluate(values []float64, thresholds []threshold) ([]float64, string) {
+	smoothed := p.smooth(values)
+	direction := determineScalingDirection(smoothed, p.adjustThresholds(smoothed, thresholds))
+
+	// Require the same direction for several samples in a row, like
+	// req-buffer-length does for concurrent requests
+	if direction == "" || direction != p.breachDir {
+		p.breaches = 0
+	}
+	p.breachDir = direction
+	if direction == "" {
+		return smoothed, ""
+	}
+
+	p.breaches++
+	if p.breaches < p.config.Breaches {
+		return smoothed, ""
+	}
+	p.breaches = 0
+	p.lastDirection = direction
+
+	return smoothed, direction
+}
+
+func (p *policy) smooth(values []float64) []float64 {
+	if p.windows == nil {
+		p.windows = make([][]float64, len(values))
+		p.averages = append([]float64(nil), values...)
+	}
+
+	smoothed := make([]float64, len(values))
+	for i, value := range values {
+		switch p.config.Method {
+		case "ewma":
+			p.averages[i] = p.config.Alpha*value + (1-p.config.Alpha)*p.averages[i]
+			smoothed[i] = p.averages[i]
+		case "mean", "median":
+			window := append(p.windows[i], value)
+			if len(window) > p.config.Window {
+				window = window[len(window)-p.config.Window:]
+			}
+			p.windows[i] = window
+			if p.config.Method == "mean" {
+				smoothed[i] = mean(window)
+			} else {
+				smoothed[i] = median(window)
+			}
+		default:
+			smoothed[i] = value
+		}
+	}
+	return smoothed
+}
+
+// adjustThresholds applies the hysteresis band. After scaling up the lower
+// bound is pushed down, and after scaling down the upper bound is pushed up,
+// so a value that only just crossed a threshold can't flip the direction
+// straight away. The band is dropped once every value settles well inside
+// the thresholds again.
+func (p *policy) adjustThresholds(values []float64, thresholds []threshold) []threshold {
+	band := p.config.Hysteresis
+	if band == 0 || p.lastDirection == "" {
+		return thresholds
+	}
+
+	settled := true
+	for i, value := range values {
+		bounds := thresholds[i]
+		if (bounds.upper >= 0 && value > bounds.upper*(1-band)) || (bounds.lower >= 0 && value < bounds.lower*(1+band)) {
+			settled = false
+		}
+	}
+	if settled {
+		p.lastDirection = ""
+		return thresholds
+	}
+
+	adjusted := make([]threshold, len(thresholds))
+	for i, bounds := range thresholds {
+		adjusted[i] = bounds
+		if p.lastDirection == "over" && bounds.lower >= 0 {
+			adjusted[i].lower = bounds.lower * (1 - band)
+		} else if p.lastDirection == "under" && bounds.upper >= 0 {
+			adjusted[i].upper = bounds.upper * (1 + band)
+		}
+	}
+	return adjusted
+}
+
+// mean and median are 0 for an empty window
+func mean(window []float64) float64 {
+	if len(window) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, value := range window {
+		sum += value
+	}
+	return sum / float64(len(window))
+}
+
+func median(window []float64) float64 {
+	if len(window) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), window...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -0,0 +1,183 @@
+package cgroup_monitoring
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMeanMedian(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     []float64
+		wantMean   float64
+		wantMedian float64
+	}{
+		{"empty", nil, 0, 0},
+		{"one", []float64{7}, 7, 7},
+		{"odd", []float64{30, 10, 20}, 20, 20},
+		{"even", []float64{40, 10, 10, 20}, 20, 15},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window := slices.Clone(tt.window)
+			if got := mean(window); got != tt.wantMean {
+				t.Errorf("mean() = %v, want %v", got, tt.wantMean)
+			}
+			if got := median(window); got != tt.wantMedian {
+				t.Errorf("median() = %v, want %v", got, tt.wantMedian)
+			}
+			if !slices.Equal(window, tt.window) {
+				t.Errorf("window changed to %v", window)
+			}
+		})
+	}
+}
+
+func TestPolicySmooth(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SmoothingConfig
+		values []float64
+		want   []float64
+	}{
+		{"none", SmoothingConfig{Method: "none"}, []float64{10, 50, 20}, []float64{10, 50, 20}},
+		{"unknown method", SmoothingConfig{Method: "max"}, []float64{10, 50, 20}, []float64{10, 50, 20}},
+		{"ewma", SmoothingConfig{Method: "ewma", Alpha: 0.5}, []float64{10, 20, 40}, []float64{10, 15, 27.5}},
+		{"ewma of one sample", SmoothingConfig{Method: "ewma", Alpha: 0.5}, []float64{10}, []float64{10}},
+		{"ewma with invalid alpha", SmoothingConfig{Method: "ewma", Alpha: 2}, []float64{10, 20}, []float64{10, 15}},
+		{"mean", SmoothingConfig{Method: "mean", Window: 3}, []float64{10, 20, 30, 70}, []float64{10, 15, 20, 40}},
+		{"mean window of one", SmoothingConfig{Method: "mean", Window: 1}, []float64{10, 20, 30}, []float64{10, 20, 30}},
+		{"mean without window", SmoothingConfig{Method: "mean"}, []float64{10, 20, 30}, []float64{10, 20, 30}},
+		{"median", SmoothingConfig{Method: "median", Window: 3}, []float64{10, 50, 20, 30}, []float64{10, 30, 20, 30}},
+		{"median window of one", SmoothingConfig{Method: "median", Window: 1}, []float64{10, 50, 20}, []float64{10, 50, 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPolicy(tt.config)
+			var got []float64
+			for _, value := range tt.values {
+				got = append(got, p.smooth([]float64{value})[0])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("smoothed %v to %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicySmoothsEachValue(t *testing.T) {
+	p := newPolicy(SmoothingConfig{Method: "mean", Window: 2})
+	p.smooth([]float64{10, 100})
+	if got := p.smooth([]float64{20, 300}); !slices.Equal(got, []float64{15, 200}) {
+		t.Errorf("got %v, want [15 200]", got)
+	}
+}
+
+func TestDetermineScalingDirection(t *testing.T) {
+	bounds := threshold{lower: 20, upper: 80}
+
+	tests := []struct {
+		name       string
+		values     []float64
+		thresholds []threshold
+		want       string
+	}{
+		{"inside", []float64{50}, []threshold{bounds}, ""},
+		{"above upper", []float64{81}, []threshold{bounds}, "over"},
+		{"below lower", []float64{19}, []threshold{bounds}, "under"},
+		{"equal to upper", []float64{80}, []threshold{bounds}, ""},
+		{"equal to lower", []float64{20}, []threshold{bounds}, ""},
+		{"disabled bounds", []float64{1000}, []threshold{{lower: -1, upper: -1}}, ""},
+		{"any value over", []float64{10, 90}, []threshold{bounds, bounds}, "over"},
+		{"only one value under", []float64{10, 50}, []threshold{bounds, bounds}, ""},
+		{"every value under", []float64{10, 10}, []threshold{bounds, bounds}, "under"},
+		{"value without lower bound", []float64{10, 5}, []threshold{bounds, {lower: -1, upper: 80}}, "under"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := determineScalingDirection(tt.values, tt.thresholds); got != tt.want {
+				t.Errorf("determineScalingDirection(%v) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+// step is a sample fed to a policy and the direction it should return
+type step struct {
+	value float64
+	want  string
+}
+
+func runPolicy(t *testing.T, p *policy, bounds threshold, steps []step) {
+	t.Helper()
+	for i, s := range steps {
+		if _, got := p.evaluate([]float64{s.value}, []threshold{bounds}); got != s.want {
+			t.Errorf("sample %d (%v): got %q, want %q", i, s.value, got, s.want)
+		}
+	}
+}
+
+func TestPolicyBreaches(t *testing.T) {
+	bounds := threshold{lower: 20, upper: 80}
+
+	tests := []struct {
+		name     string
+		breaches int
+		steps    []step
+	}{
+		{"one breach", 1, []step{{90, "over"}, {90, "over"}, {10, "under"}}},
+		{"default", 0, []step{{90, "over"}, {50, ""}}},
+		{"consecutive", 3, []step{{90, ""}, {90, ""}, {90, "over"}, {90, ""}}},
+		{"interrupted", 3, []step{{90, ""}, {90, ""}, {50, ""}, {90, ""}, {90, ""}, {90, "over"}}},
+		{"direction changed", 2, []step{{90, ""}, {10, ""}, {10, "under"}}},
+		{"value equal to the threshold", 2, []step{{90, ""}, {80, ""}, {90, ""}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runPolicy(t, newPolicy(SmoothingConfig{Breaches: tt.breaches}), bounds, tt.steps)
+		})
+	}
+}
+
+func TestPolicyHysteresis(t *testing.T) {
+	bounds := threshold{lower: 20, upper: 80}
+
+	tests := []struct {
+		name       string
+		hysteresis float64
+		steps      []step
+	}{
+		{"disabled", 0, []step{{90, "over"}, {18, "under"}}},
+		{"lower bound pushed down after scaling up", 0.2, []step{{90, "over"}, {18, ""}, {15, "under"}}},
+		{"upper bound pushed up after scaling down", 0.2, []step{{10, "under"}, {90, ""}, {97, "over"}}},
+		{"value equal to the pushed bound", 0.2, []step{{90, "over"}, {16, ""}}},
+		{"band dropped once settled", 0.2, []step{{90, "over"}, {30, ""}, {18, "under"}}},
+		{"not settled inside the band", 0.2, []step{{90, "over"}, {23, ""}, {18, ""}}},
+		{"settled at the edge of the band", 0.2, []step{{90, "over"}, {24, ""}, {18, "under"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runPolicy(t, newPolicy(SmoothingConfig{Hysteresis: tt.hysteresis}), bounds, tt.steps)
+		})
+	}
+}
+
+func TestSmoothingWithLabels(t *testing.T) {
+	config := SmoothingConfig{Method: "none", Alpha: 0.3, Window: 5, Breaches: 1, Hysteresis: 0.1}
+
+	got := config.withLabels(map[string]string{
+		smoothingLabel:  "median",
+		windowLabel:     "7",
+		breachesLabel:   "three", // invalid, keeps the node config
+		hysteresisLabel: "0.25",
+	})
+	want := SmoothingConfig{Method: "median", Alpha: 0.3, Window: 7, Breaches: 1, Hysteresis: 0.25}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
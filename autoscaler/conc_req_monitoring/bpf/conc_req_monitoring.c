@@ -1,6 +1,21 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_core_read.h>
+#include <bpf/bpf_tracing.h>
+
+// Every map below keyed by "netns" uses the tracking key of a container. By
+// default that is its network namespace inode. With key_by_cgroup set, user
+// space assigns each container a key and maps its cgroup to it, so containers
+// on the host network or sharing a netns are counted separately.
+volatile const u32 key_by_cgroup = 0;
+
+// cgroup v2 ID -> tracking key, only used with key_by_cgroup
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u64);
+    __type(value, u32);
+    __uint(max_entries, 1024);
+} cgroup_keys_map SEC(".maps");
 
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
@@ -9,12 +24,23 @@ struct {
     __uint(max_entries, 1024);
 } conn_count_map SEC(".maps");
 
+// Scaling settings per netns. Key 0 holds the node-wide settings, used by any
+// netns without an entry of its own.
+#define THRESHOLD_DISABLED 0xFFFFFFFF
+
+struct netns_config {
+    u32 lower_limit;
+    u32 upper_limit;
+    u32 buffer_length;
+    u32 metric;
+};
+
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __type(key, u32);
-    __type(value, u32);
+    __type(value, struct netns_config);
     __uint(max_entries, 1024);
-} constants_map SEC(".maps");
+} config_map SEC(".maps");
 
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
@@ -37,99 +63,269 @@ struct {
     __uint(max_entries, 1024);
 } valid_netns_map SEC(".maps");
 
+struct listen_key {
+    u32 netns;
+    u16 port;
+    u16 pad;
+};
+
+// Listening ports of tracked namespaces, only connections accepted on these
+// ports are counted
 struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(max_entries, 8); // Set this to the number of CPUs
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct listen_key);
+    __type(value, u8);
+    __uint(max_entries, 4096);
+} listen_ports_map SEC(".maps");
+
+// Sockets currently counted in conn_count_map, mapped to their netns, so every
+// connection is decremented exactly once
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u64);
+    __type(value, u32);
+    __uint(max_entries, 65536);
+} counted_socks_map SEC(".maps");
+
+// Metrics that can be compared with the thresholds, selected by the metric
+// field of netns_config
+enum metric {
+    METRIC_CONNECTIONS = 0,
+    METRIC_RPS = 1,
+    METRIC_LATENCY = 2,
+};
+
+#define RPS_WINDOW_NS 1000000000ULL
+
+// Sliding window request counter, the rate is estimated by weighting the
+// previous window by how much of it still overlaps the last second
+struct rps_window {
+    u64 window_start_ns;
+    u32 prev_count;
+    u32 curr_count;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u32);
+    __type(value, struct rps_window);
+    __uint(max_entries, 1024);
+} rps_map SEC(".maps");
+
+// Total connections accepted on listening ports per netns
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u32);
+    __type(value, u64);
+    __uint(max_entries, 1024);
+} accept_count_map SEC(".maps");
+
+// Server-side sockets of tracked namespaces. A request starts with the first
+// read returning data after the previous response was sent.
+struct req_state {
+    u64 start_ns;
+    u32 netns;
+    u32 awaiting_response;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u64);
+    __type(value, struct req_state);
+    __uint(max_entries, 65536);
+} req_state_map SEC(".maps");
+
+// Tracked sockets in tcp_recvmsg per thread, so the kretprobe knows which
+// socket the return value belongs to
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u64);
+    __type(value, u64);
+    __uint(max_entries, 65536);
+} recvmsg_socks_map SEC(".maps");
+
+// Number of arguments of the functions followed with fexit, whose return
+// value comes after them in the context. inet_csk_accept lost two in 6.10,
+// tcp_recvmsg its nonblock argument in 5.19 and addr_len later on. Set by the
+// loader from the kernel BTF.
+volatile const u32 accept_args = 4;
+volatile const u32 recvmsg_args = 5;
+
+// Request latency histogram per netns. Slot i counts requests that took
+// [2^i, 2^(i+1)) microseconds, slot 0 also holds anything under 1us and the
+// last slot anything longer.
+#define LATENCY_SLOTS 32
+
+struct latency_hist {
+    u64 slots[LATENCY_SLOTS];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u32);
+    __type(value, struct latency_hist);
+    __uint(max_entries, 1024);
+} latency_hist_map SEC(".maps");
+
+// Scaling events for user space. The ring buffer is used when the kernel
+// supports it (5.8+), otherwise the loader clears use_ringbuf and events go
+// through the perf event array, which is sized to the CPU count at load time.
+volatile const u32 use_ringbuf = 1;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-struct data_t {
+struct {
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+    __uint(key_size, sizeof(u32));
+    __uint(value_size, sizeof(u32));
+} events_perf SEC(".maps");
+
+// Events that couldn't be queued because the buffer was full
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, u32);
+    __type(value, u64);
+    __uint(max_entries, 1);
+} dropped_events SEC(".maps");
+
+enum scale_direction {
+    SCALE_DOWN = 1,
+    SCALE_UP = 2,
+};
+
+// Sent to user space when a netns stayed outside its thresholds for
+// buffer_length consecutive samples
+struct scale_event {
+    u64 timestamp_ns;
     u32 netns;
-    char message[6];
+    enum scale_direction direction;
+    u32 metric;
+    u32 value;
+    u32 lower_limit;
+    u32 upper_limit;
+    u32 buffer;
+    u32 buffer_length;
 };
 
-static __always_inline u32 get_netns_from_task(struct task_struct *task) {
-    struct nsproxy *ns = NULL;
-    struct net *net = NULL;
-    u32 netns = 0;
+// Keep scale_event in the BTF so bpf2go generates a Go type for it
+const struct scale_event *unused_scale_event __attribute__((unused));
 
-    bpf_core_read(&ns, sizeof(ns), &task->nsproxy);
-    if (ns) {
-        bpf_core_read(&net, sizeof(net), &ns->net_ns);
-        if (net) {
-            bpf_core_read(&netns, sizeof(netns), &net->ns.inum);
-        }
-    }
-    return netns;
+static __always_inline u32 get_netns_from_sock(const struct sock *sk) {
+    return BPF_CORE_READ(sk, __sk_common.skc_net.net, ns.inum);
 }
 
-SEC("kprobe/tcp_recvmsg")
-int kprobe_tcp_recvmsg(struct pt_regs *ctx) {
-    struct sock *sk = NULL;
-    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
-    u32 netns = get_netns_from_task(task);
+// get_key_from_sock returns the tracking key of the container owning the
+// socket, or 0 if it isn't tracked. Accepted sockets inherit the cgroup of
+// their listener, so this also works in softirq where the current task is
+// unrelated.
+static __always_inline u32 get_key_from_sock(const struct sock *sk) {
+    if (!key_by_cgroup) {
+        return get_netns_from_sock(sk);
+    }
 
-    //bpf_printk("netns: %u\n", netns);
+    // The cgroup pointer replaced a packed value in 5.15
+    if (!bpf_core_field_exists(sk->sk_cgrp_data.cgroup)) {
+        return 0;
+    }
+    u64 cgroup_id = BPF_CORE_READ(sk, sk_cgrp_data.cgroup, kn, id);
+    u32 *key = bpf_map_lookup_elem(&cgroup_keys_map, &cgroup_id);
+    return key ? *key : 0;
+}
 
+static __always_inline struct netns_config *get_config(u32 netns) {
+    struct netns_config *config = bpf_map_lookup_elem(&config_map, &netns);
+    if (!config) {
+        u32 global = 0;
+        config = bpf_map_lookup_elem(&config_map, &global);
+    }
+    return config;
+}
 
-    // Read the sk pointer from the first argument of tcp_recvmsg
-    bpf_probe_read_kernel(&sk, sizeof(sk), (void *)&ctx->di);
+static __always_inline u32 get_metric(u32 netns) {
+    struct netns_config *config = get_config(netns);
+    return config ? config->metric : METRIC_CONNECTIONS;
+}
 
-    if (!sk) {
-        //bpf_printk("Failed to read sk pointer\n");
-        return 0;
+// record_request counts a request for the netns. The rate is compared with
+// the thresholds by user space every collection period, so it still drops
+// once requests stop arriving.
+static __always_inline void record_request(u32 netns) {
+    struct rps_window *window = bpf_map_lookup_elem(&rps_map, &netns);
+    if (!window) {
+        return;
     }
 
-    // Check if the namespace is valid for tracked containers
-    u32 *valid_ns = bpf_map_lookup_elem(&valid_netns_map, &netns);
-    if (!valid_ns) {
-        //bpf_printk("Namespace %u is not valid.\n", netns);
-        return 0;
+    u64 now = bpf_ktime_get_ns();
+    u64 elapsed = now - window->window_start_ns;
+    if (elapsed >= 2 * RPS_WINDOW_NS) {
+        // Idle for more than a whole window, start afresh
+        window->prev_count = 0;
+        window->curr_count = 0;
+        window->window_start_ns = now;
+    } else if (elapsed >= RPS_WINDOW_NS) {
+        window->prev_count = window->curr_count;
+        window->curr_count = 0;
+        window->window_start_ns += RPS_WINDOW_NS;
     }
+    window->curr_count++;
+}
 
-    // Determine the TCP state using bpf_core_read
-    u8 state = 0;
-    bpf_core_read(&state, sizeof(state), &sk->__sk_common.skc_state);
+static __always_inline u32 log2_u64(u64 v) {
+    u32 r = 0;
+    if (v >> 32) { v >>= 32; r += 32; }
+    if (v >> 16) { v >>= 16; r += 16; }
+    if (v >> 8) { v >>= 8; r += 8; }
+    if (v >> 4) { v >>= 4; r += 4; }
+    if (v >> 2) { v >>= 2; r += 2; }
+    if (v >> 1) { r += 1; }
+    return r;
+}
 
-    
+static __always_inline void record_latency(u32 netns, u64 latency_ns) {
+    struct latency_hist *hist = bpf_map_lookup_elem(&latency_hist_map, &netns);
+    if (!hist) {
+        return;
+    }
 
-    u32 new_value = 0;
-    u32 key = 0;
-    u32 *lowerLimit = bpf_map_lookup_elem(&constants_map, &key);
-    key = 1;
-    u32 *upperLimit = bpf_map_lookup_elem(&constants_map, &key);
-    key = 2;
-    u32 *bufferLength = bpf_map_lookup_elem(&constants_map, &key);
-
-    if (!lowerLimit || !upperLimit || !bufferLength) {
-        //bpf_printk("Missing constants.\n");
-        return 0;
+    u32 slot = log2_u64(latency_ns / 1000);
+    if (slot >= LATENCY_SLOTS) {
+        slot = LATENCY_SLOTS - 1;
     }
+    __sync_fetch_and_add(&hist->slots[slot], 1);
+}
 
-    u32 zero32 = 0;
-    u32 *count = bpf_map_lookup_elem(&conn_count_map, &netns);
-    if (!count) {
-        bpf_map_update_elem(&conn_count_map, &netns, &zero32, BPF_NOEXIST);
-        count = &zero32;
+static __always_inline void emit_event(void *ctx, void *data, u64 size) {
+    long err;
+    if (use_ringbuf) {
+        err = bpf_ringbuf_output(&events, data, size, 0);
+    } else {
+        err = bpf_perf_event_output(ctx, &events_perf, BPF_F_CURRENT_CPU, data, size);
     }
 
-    if (state == TCP_ESTABLISHED) {
-        (*count)++;
-        new_value = *count;
-    } else if (state == TCP_CLOSE || state == TCP_CLOSE_WAIT || TCP_LAST_ACK) {
-        if (*count > 0) {
-            (*count)--;
-            new_value = *count;
+    if (err) {
+        u32 key = 0;
+        u64 *dropped = bpf_map_lookup_elem(&dropped_events, &key);
+        if (dropped) {
+            (*dropped)++;
         }
-    } else {
-        bpf_printk("TCP state: %u\n", state);
     }
-    
+}
 
-    bpf_printk("Connection count for netns %u: %u\n", netns, new_value);
+// check_thresholds counts consecutive samples outside the thresholds and
+// signals user space once req-buffer-length is reached
+static __always_inline void check_thresholds(void *ctx, u32 netns, u32 new_value) {
+    struct netns_config *config = get_config(netns);
+    if (!config) {
+        //bpf_printk("Missing config.\n");
+        return;
+    }
 
     u32 *scaling = bpf_map_lookup_elem(&scaling_map, &netns);
     if (scaling && *scaling == 1) {
-        return 0;
+        return;
     }
 
     u32 initial = 0;
@@ -139,7 +335,10 @@ int kprobe_tcp_recvmsg(struct pt_regs *ctx) {
         buffer = &initial;
     }
 
-    if (new_value <= *lowerLimit || new_value >= *upperLimit) {
+    bool below = config->lower_limit != THRESHOLD_DISABLED && new_value <= config->lower_limit;
+    bool above = config->upper_limit != THRESHOLD_DISABLED && new_value >= config->upper_limit;
+
+    if (below || above) {
         (*buffer)++;
     } else {
         *buffer = 0;
@@ -147,28 +346,259 @@ int kprobe_tcp_recvmsg(struct pt_regs *ctx) {
 
     bpf_map_update_elem(&buffer_map, &netns, buffer, BPF_ANY);
 
-    if (*buffer == *bufferLength) {
+    if (*buffer == config->buffer_length) {
         u32 scaling_value = 1;
         bpf_map_update_elem(&scaling_map, &netns, &scaling_value, BPF_ANY);
 
-        struct data_t data = {};
-        data.netns = netns;
-        if (new_value <= *lowerLimit) {
-            __builtin_memcpy(data.message, "Lower", 5);
-        } else {
-            __builtin_memcpy(data.message, "Upper", 5);
-        }
-        data.message[5] = '\0';
+        struct scale_event event = {};
+        event.timestamp_ns = bpf_ktime_get_ns();
+        event.netns = netns;
+        event.direction = below ? SCALE_DOWN : SCALE_UP;
+        event.metric = config->metric;
+        event.value = new_value;
+        event.lower_limit = config->lower_limit;
+        event.upper_limit = config->upper_limit;
+        event.buffer = *buffer;
+        event.buffer_length = config->buffer_length;
 
-        bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &data, sizeof(data));
+        emit_event(ctx, &event, sizeof(event));
 
         u32 zero = 0;
         bpf_map_update_elem(&buffer_map, &netns, &zero, BPF_ANY);
 
         //bpf_printk("Scaling triggered for netns %u\n", netns);
     }
+}
+
+// A server-side connection is opened when a socket moves from SYN_RECV to
+// ESTABLISHED and closed when it leaves ESTABLISHED. Client-side connections
+// made by the container go through SYN_SENT and are never counted.
+SEC("tracepoint/sock/inet_sock_set_state")
+int tracepoint_inet_sock_set_state(struct trace_event_raw_inet_sock_set_state *ctx) {
+    if (ctx->protocol != IPPROTO_TCP) {
+        return 0;
+    }
+
+    u64 skaddr = (u64)ctx->skaddr;
+    u32 netns = 0;
+    u32 new_value = 0;
+
+    if (ctx->oldstate == TCP_SYN_RECV && ctx->newstate == TCP_ESTABLISHED) {
+        // Taken from the socket, the current task is unrelated in softirq
+        netns = get_key_from_sock(ctx->skaddr);
+        if (!netns) {
+            return 0;
+        }
+
+        struct listen_key lkey = {};
+        lkey.netns = netns;
+        lkey.port = ctx->sport; // already host byte order in the tracepoint
+        if (!bpf_map_lookup_elem(&listen_ports_map, &lkey)) {
+            return 0;
+        }
+
+        if (bpf_map_update_elem(&counted_socks_map, &skaddr, &netns, BPF_NOEXIST) != 0) {
+            return 0;
+        }
+
+        u32 *count = bpf_map_lookup_elem(&conn_count_map, &netns);
+        if (!count) {
+            return 0;
+        }
+        __sync_fetch_and_add(count, 1);
+        new_value = *count;
+    } else if (ctx->oldstate == TCP_ESTABLISHED) {
+        bpf_map_delete_elem(&req_state_map, &skaddr);
+
+        u32 *counted_netns = bpf_map_lookup_elem(&counted_socks_map, &skaddr);
+        if (!counted_netns) {
+            return 0;
+        }
+        netns = *counted_netns;
+        bpf_map_delete_elem(&counted_socks_map, &skaddr);
+
+        u32 *count = bpf_map_lookup_elem(&conn_count_map, &netns);
+        if (!count || *count == 0) {
+            return 0;
+        }
+        __sync_fetch_and_add(count, -1);
+        new_value = *count;
+    } else {
+        return 0;
+    }
+
+    //bpf_printk("Connection count for netns %u: %u\n", netns, new_value);
+
+    // Namespace may have stopped being tracked since the connection opened
+    u32 *valid_ns = bpf_map_lookup_elem(&valid_netns_map, &netns);
+    if (!valid_ns) {
+        return 0;
+    }
+
+    if (get_metric(netns) == METRIC_CONNECTIONS) {
+        check_thresholds(ctx, netns, new_value);
+    }
 
     return 0;
 }
 
+// Register sockets returned by accept() on a tracked listening port so their
+// requests can be counted
+static __always_inline int handle_accept(struct sock *sk) {
+    if (!sk) {
+        return 0;
+    }
+
+    u32 netns = get_key_from_sock(sk);
+    u32 *valid_ns = bpf_map_lookup_elem(&valid_netns_map, &netns);
+    if (!valid_ns) {
+        return 0;
+    }
+
+    struct listen_key lkey = {};
+    lkey.netns = netns;
+    lkey.port = BPF_CORE_READ(sk, __sk_common.skc_num);
+    if (!bpf_map_lookup_elem(&listen_ports_map, &lkey)) {
+        return 0;
+    }
+
+    u64 skaddr = (u64)sk;
+    struct req_state state = {};
+    state.netns = netns;
+    bpf_map_update_elem(&req_state_map, &skaddr, &state, BPF_ANY);
+
+    u64 *accepted = bpf_map_lookup_elem(&accept_count_map, &netns);
+    if (accepted) {
+        __sync_fetch_and_add(accepted, 1);
+    }
+
+    return 0;
+}
+
+// handle_recvmsg runs when tcp_recvmsg returns. Only a read that returned
+// data starts a request, an empty or failed read (e.g. EAGAIN on a
+// non-blocking socket) doesn't.
+static __always_inline int handle_recvmsg(struct sock *sk, long ret) {
+    if (!sk || ret <= 0) {
+        return 0;
+    }
+
+    u64 skaddr = (u64)sk;
+    struct req_state *state = bpf_map_lookup_elem(&req_state_map, &skaddr);
+    if (!state || state->awaiting_response) {
+        // Not a tracked server socket, or more segments of the same request
+        return 0;
+    }
+    state->awaiting_response = 1;
+    state->start_ns = bpf_ktime_get_ns();
+
+    record_request(state->netns);
+
+    return 0;
+}
+
+static __always_inline int handle_sendmsg(struct sock *sk) {
+    if (!sk) {
+        return 0;
+    }
+
+    u64 skaddr = (u64)sk;
+    struct req_state *state = bpf_map_lookup_elem(&req_state_map, &skaddr);
+    if (!state || !state->awaiting_response) {
+        return 0;
+    }
+
+    // Response started, the next read is a new request. Percentiles are
+    // worked out in user space, so there is no threshold check here.
+    state->awaiting_response = 0;
+    record_latency(state->netns, bpf_ktime_get_ns() - state->start_ns);
+
+    return 0;
+}
+
+// fentry/fexit programs get typed arguments from BTF, so they work the same
+// on every architecture. Used on kernels with BPF trampolines (5.5+).
+
+// fexit_ret returns the return value of a function with args arguments. It
+// follows them in the context, which can only be read directly at constant
+// offsets.
+static __always_inline u64 fexit_ret(u64 *ctx, u32 args) {
+    u64 ret = 0;
+    bpf_probe_read_kernel(&ret, sizeof(ret), &ctx[args]);
+    return ret;
+}
+
+SEC("fexit/inet_csk_accept")
+int fexit_inet_csk_accept(u64 *ctx) {
+    return handle_accept((struct sock *)fexit_ret(ctx, accept_args));
+}
+
+SEC("fexit/tcp_recvmsg")
+int fexit_tcp_recvmsg(u64 *ctx) {
+    return handle_recvmsg((struct sock *)ctx[0], (long)fexit_ret(ctx, recvmsg_args));
+}
+
+SEC("fentry/tcp_sendmsg")
+int fentry_tcp_sendmsg(u64 *ctx) {
+    return handle_sendmsg((struct sock *)ctx[0]);
+}
+
+// kprobe fallback. bpf2go builds an object per architecture, so
+// bpf_tracing.h knows which registers hold the arguments.
+
+#if defined(__TARGET_ARCH_arm64)
+// Registers of a kprobe on arm64, missing from a vmlinux.h dumped on x86
+struct user_pt_regs {
+    u64 regs[31];
+    u64 sp;
+    u64 pc;
+    u64 pstate;
+};
+#elif defined(__TARGET_ARCH_s390)
+// Registers of a kprobe on s390x, missing from a vmlinux.h dumped on x86
+typedef struct {
+    struct {
+        unsigned long mask;
+        unsigned long addr;
+    } psw;
+    unsigned long gprs[16];
+    unsigned long orig_gpr2;
+} user_pt_regs;
+#endif
+
+SEC("kretprobe/inet_csk_accept")
+int BPF_KRETPROBE(kretprobe_inet_csk_accept, struct sock *sk) {
+    return handle_accept(sk);
+}
+
+SEC("kprobe/tcp_recvmsg")
+int BPF_KPROBE(kprobe_tcp_recvmsg, struct sock *sk) {
+    u64 skaddr = (u64)sk;
+    if (!bpf_map_lookup_elem(&req_state_map, &skaddr)) {
+        return 0;
+    }
+
+    u64 tid = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&recvmsg_socks_map, &tid, &skaddr, BPF_ANY);
+    return 0;
+}
+
+SEC("kretprobe/tcp_recvmsg")
+int BPF_KRETPROBE(kretprobe_tcp_recvmsg, long ret) {
+    u64 tid = bpf_get_current_pid_tgid();
+    u64 *skaddr = bpf_map_lookup_elem(&recvmsg_socks_map, &tid);
+    if (!skaddr) {
+        return 0;
+    }
+    struct sock *sk = (struct sock *)*skaddr;
+    bpf_map_delete_elem(&recvmsg_socks_map, &tid);
+
+    return handle_recvmsg(sk, ret);
+}
+
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(kprobe_tcp_sendmsg, struct sock *sk) {
+    return handle_sendmsg(sk);
+}
+
 char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,68 @@
+package conc_req_monitoring
+
+import (
+    "errors"
+    "fmt"
+    "sync/atomic"
+
+    "cgroup_monitoring"
+    "scale"
+
+    "github.com/cilium/ebpf/btf"
+)
+
+// Keys handed out to containers when counting by cgroup. Namespace inodes
+// aren't used in that mode, so the keys only have to be unique and non-zero.
+var lastCgroupKey atomic.Uint32
+
+// trackingKey returns the key the BPF program counts the container's
+// connections under, and a function that releases it once the container
+// stops. By default this is the container's network namespace. Containers on
+// the host network, or sharing a namespace, can only be told apart by cgroup.
+func trackingKey(containerID string, byCgroup bool) (uint32, func(), error) {
+    if !byCgroup {
+        netns, err := scale.GetContainerNamespace(containerID)
+        return netns, func() {}, err
+    }
+
+    cgroupID, err := cgroup_monitoring.CgroupID(containerID)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    key := lastCgroupKey.Add(1)
+    if err := listenerInstance.CgroupKeysMap.Put(cgroupID, key); err != nil {
+        return 0, nil, fmt.Errorf("adding cgroup %d to CgroupKeysMap: %v", cgroupID, err)
+    }
+    fmt.Printf("Counting cgroup %d of container %s as key %d\n", cgroupID, containerID, key)
+
+    release := func() {
+        if err := listenerInstance.CgroupKeysMap.Delete(cgroupID); err != nil {
+            fmt.Printf("Failed to delete cgroup %d from CgroupKeysMap: %v\n", cgroupID, err)
+        }
+        cgroup_monitoring.ForgetCgroupID(containerID)
+    }
+    return key, release, nil
+}
+
+// checkCgroupKeys makes sure the BPF program can read the cgroup of a socket.
+// It reads the sock_cgroup_data cgroup pointer, which replaced a packed value
+// in 5.15. Before that every socket would get key 0 and nothing would be
+// counted.
+func checkCgroupKeys() error {
+    spec, err := btf.LoadKernelSpec()
+    if err != nil {
+        return fmt.Errorf("reading kernel BTF: %v", err)
+    }
+
+    var data *btf.Struct
+    if err := spec.TypeByName("sock_cgroup_data", &data); err != nil {
+        return fmt.Errorf("looking up sock_cgroup_data: %v", err)
+    }
+    for _, member := range data.Members {
+        if member.Name == "cgroup" {
+            return nil
+        }
+    }
+    return errors.New("sockets have no cgroup pointer, Linux 5.15 or later is needed")
+}
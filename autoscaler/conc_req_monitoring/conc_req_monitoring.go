@@ -1,40 +1,41 @@
 package conc_req_monitoring
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang BPF bpf/conc_req_monitoring.c -- -I/usr/include -g
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target amd64,arm64,s390x -type scale_event -type scale_direction BPF bpf/conc_req_monitoring.c -- -I/usr/include -g
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strings"
 	"sync"
 	"time"
 
+	"bpf_events"
+	"logging"
 	"scale"
 	"server"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/perf"
 	"github.com/cilium/ebpf/rlimit"
 )
 
-type Data struct {
-    Netns   uint32
-    Message [6]byte
-}
-
 type BPFListener struct {
-    PerfReader       *perf.Reader
-    ConstantsMap     *ebpf.Map
+    EventReader      *bpf_events.Reader
+    ConfigMap        *ebpf.Map
     BufferMap        *ebpf.Map
     ConnCountMap     *ebpf.Map
     ScalingMap       *ebpf.Map
     ValidNetnsMap    *ebpf.Map
+    ListenPortsMap   *ebpf.Map
+    CgroupKeysMap    *ebpf.Map
+    CountedSocksMap  *ebpf.Map
+    RPSMap           *ebpf.Map
+    AcceptCountMap   *ebpf.Map
+    ReqStateMap      *ebpf.Map
+    LatencyHistMap   *ebpf.Map
     Events           *ebpf.Map
-    TcpRecvMsgLink   link.Link
+    SockStateLink    link.Link
+    RequestLinks     []link.Link
     closing          chan struct{}
     closed           bool
     mu               sync.Mutex
@@ -44,12 +45,17 @@ type ConcReqResource struct {
     LowerLimit   int64
     UpperLimit   int64
     BufferLength int64
+    Metric       Metric
+    Cooldown     time.Duration // longest wait for new replicas before scaling again
+    ByCgroup     bool          // count per container cgroup instead of per network namespace
 }
 
 type NamespaceContext struct {
-    Ctx    context.Context
-    Cancel context.CancelFunc
-    Signal chan string
+    Ctx         context.Context
+    Cancel      context.CancelFunc
+    Signal      chan BPFScaleEvent
+    ContainerID string
+    ServiceID   string
 }
 
 type NamespaceContextMap struct {
@@ -83,8 +89,6 @@ func InitBPFListener(resource ConcReqResource) error {
         return fmt.Errorf("failed to remove memlock limit: %v", err)
     }
 
-    
-    objs := BPFObjects{}
     opts := ebpf.CollectionOptions{
         Programs: ebpf.ProgramOptions{
             LogLevel: ebpf.LogLevelInstruction,
@@ -92,50 +96,92 @@ func InitBPFListener(resource ConcReqResource) error {
         },
     }
 
-    if err := LoadBPFObjects(&objs, &opts); err != nil {
+    spec, err := LoadBPF()
+    if err != nil {
+        return fmt.Errorf("loading spec: %v", err)
+    }
+
+    useRingbuf, err := bpf_events.Configure(spec)
+    if err != nil {
+        return err
+    }
+
+    keyByCgroup := uint32(0)
+    if resource.ByCgroup {
+        if err := checkCgroupKeys(); err != nil {
+            return fmt.Errorf("conc-req-key cgroup isn't supported: %v", err)
+        }
+        keyByCgroup = 1
+    }
+    constants := map[string]interface{}{"key_by_cgroup": keyByCgroup}
+    if resource.Metric != MetricConnections {
+        fexitConstants(constants)
+    }
+    if err := spec.RewriteConstants(constants); err != nil {
+        return fmt.Errorf("setting constants: %v", err)
+    }
+
+    // Request probes are only needed when scaling on per-request metrics
+    coll, mode, err := loadCollection(spec, opts, resource.Metric != MetricConnections)
+    if err != nil {
         return fmt.Errorf("loading objects: %v", err)
     }
 
+    objs := listenerObjects{}
+    if err := coll.Assign(&objs); err != nil {
+        return fmt.Errorf("assigning objects: %v", err)
+    }
+
     fmt.Println("Loading program...")
 
-    // Attach the eBPF program to the kprobes
-    tcpRecvMsgLink, err := link.Kprobe("tcp_recvmsg", objs.KprobeTcpRecvmsg, nil)
+    // Attach the eBPF program to the TCP state change tracepoint
+    sockStateLink, err := link.Tracepoint("sock", "inet_sock_set_state", objs.TracepointInetSockSetState, nil)
     if err != nil {
-        return fmt.Errorf("attaching tcp_recvmsg kprobe: %v", err)
+        return fmt.Errorf("attaching inet_sock_set_state tracepoint: %v", err)
     }
 
-    perfReader, err := perf.NewReader(objs.Events, os.Getpagesize())
+    var requestLinks []link.Link
+    if mode != "" {
+        if requestLinks, err = attachRequestProbes(coll, mode); err != nil {
+            return err
+        }
+        fmt.Printf("Request probes attached in %s mode\n", mode)
+        logging.AddEventLog(fmt.Sprintf("Request probes attached in %s mode", mode))
+    }
+
+    eventReader, err := bpf_events.NewReader("concurrent request", useRingbuf, objs.Events, objs.EventsPerf, objs.DroppedEvents)
     if err != nil {
-        return fmt.Errorf("creating perf reader: %v", err)
+        return err
     }
 
     listener := &BPFListener{
-        PerfReader:       perfReader,
-        ConstantsMap:     objs.ConstantsMap,
+        EventReader:      eventReader,
+        ConfigMap:        objs.ConfigMap,
         BufferMap:        objs.BufferMap,
         ConnCountMap:     objs.ConnCountMap,
         ScalingMap:       objs.ScalingMap,
         ValidNetnsMap:    objs.ValidNetnsMap,
+        ListenPortsMap:   objs.ListenPortsMap,
+        CgroupKeysMap:    objs.CgroupKeysMap,
+        CountedSocksMap:  objs.CountedSocksMap,
+        RPSMap:           objs.RpsMap,
+        AcceptCountMap:   objs.AcceptCountMap,
+        ReqStateMap:      objs.ReqStateMap,
+        LatencyHistMap:   objs.LatencyHistMap,
         Events:           objs.Events,
-        TcpRecvMsgLink:   tcpRecvMsgLink,
+        SockStateLink:    sockStateLink,
+        RequestLinks:     requestLinks,
         closing:          make(chan struct{}),
         closed:           false,
     }
 
     go listener.listenForEvents()
 
-    lowerLimitKey := uint32(0)
-    upperLimitKey := uint32(1)
-    bufferLengthKey := uint32(2)
+    // Node-wide thresholds, used for every namespace without its own entry
+    globalKey := uint32(0)
 
-    if err := listener.ConstantsMap.Put(lowerLimitKey, uint32(resource.LowerLimit)); err != nil {
-        log.Fatalf("updating constants_map: %v", err)
-    }
-    if err := listener.ConstantsMap.Put(upperLimitKey, uint32(resource.UpperLimit)); err != nil {
-        log.Fatalf("updating constants_map: %v", err)
-    }
-    if err := listener.ConstantsMap.Put(bufferLengthKey, uint32(resource.BufferLength)); err != nil {
-        log.Fatalf("updating constants_map: %v", err)
+    if err := listener.ConfigMap.Put(globalKey, configFor(resource)); err != nil {
+        log.Fatalf("updating config_map: %v", err)
     }
 
     listenerInstance = listener
@@ -148,8 +194,11 @@ func (s *BPFListener) Close() {
 
     if !s.closed {
         close(s.closing)
-        s.TcpRecvMsgLink.Close()
-        s.PerfReader.Close()
+        s.SockStateLink.Close()
+        for _, l := range s.RequestLinks {
+            l.Close()
+        }
+        s.EventReader.Close()
         s.closed = true
     }
 }
@@ -160,36 +209,33 @@ func (s *BPFListener) listenForEvents() {
         case <-s.closing:
             return
         default:
-            record, err := s.PerfReader.Read()
+            sample, err := s.EventReader.Read()
             if err != nil {
-                if err == perf.ErrClosed {
+                if errors.Is(err, bpf_events.ErrClosed) {
                     return // Exiting
                 }
-                fmt.Printf("Error reading perf event: %v\n", err)
-                continue
-            }
-
-            if record.LostSamples > 0 {
-                fmt.Printf("lost %d samples\n", record.LostSamples)
+                fmt.Printf("Error reading event: %v\n", err)
                 continue
             }
 
-            var data Data
-            reader := bytes.NewReader(record.RawSample)
-            if err := binary.Read(reader, binary.LittleEndian, &data); err != nil {
-                fmt.Printf("parsing event data: %v\n", err)
+            event, err := decodeScaleEvent(sample)
+            if err != nil {
+                fmt.Printf("Ignoring invalid scaling event: %v\n", err)
                 continue
             }
 
-            direction := string(data.Message[:])
             // logging.AddScalingLog(direction)
-            if nsCtx, ok := namespaceToContext.Load(data.Netns); ok {
+            if nsCtx, ok := namespaceToContext.Load(event.Netns); ok {
 
+                // Never wait on one namespace's monitor, that would hold up
+                // the events of every other namespace. An event already
+                // queued scales it anyway.
                 select {
                 case <-nsCtx.Ctx.Done():
                     // context already cancelled
+                case nsCtx.Signal <- event:
                 default:
-                    nsCtx.Signal <- direction
+                    fmt.Printf("Dropping scaling event for namespace %d, one is already pending\n", event.Netns)
                 }
 
             }
@@ -208,6 +254,21 @@ func addNamespace(netns uint32, nsCtx NamespaceContext) error {
         return err
     }
 
+    if err := listenerInstance.RPSMap.Put(netns, BPFRpsWindow{WindowStartNs: monotonicNow()}); err != nil {
+        log.Fatalf("Failed to add namespace %d to RPSMap: %v", netns, err)
+        return err
+    }
+
+    if err := listenerInstance.AcceptCountMap.Put(netns, uint64(0)); err != nil {
+        log.Fatalf("Failed to add namespace %d to AcceptCountMap: %v", netns, err)
+        return err
+    }
+
+    if err := listenerInstance.LatencyHistMap.Put(netns, BPFLatencyHist{}); err != nil {
+        log.Fatalf("Failed to add namespace %d to LatencyHistMap: %v", netns, err)
+        return err
+    }
+
     addNamespaceToScalingMap(netns)
 
     namespaceToContext.Store(netns, nsCtx)
@@ -233,6 +294,21 @@ func removeNamespace(netns uint32) error {
         return err
     }
 
+    if err := listenerInstance.RPSMap.Delete(netns); err != nil {
+        fmt.Printf("Failed to delete namespace %d from RPSMap: %v\n", netns, err)
+        return err
+    }
+
+    if err := listenerInstance.AcceptCountMap.Delete(netns); err != nil {
+        fmt.Printf("Failed to delete namespace %d from AcceptCountMap: %v\n", netns, err)
+        return err
+    }
+
+    if err := listenerInstance.LatencyHistMap.Delete(netns); err != nil {
+        fmt.Printf("Failed to delete namespace %d from LatencyHistMap: %v\n", netns, err)
+        return err
+    }
+
     namespaceToContext.Delete(netns)
     return nil
 }
@@ -246,74 +322,168 @@ func addNamespaceToScalingMap(netns uint32) error {
 }
 
 func (resource *ConcReqResource) Monitor(ctx context.Context, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
+    var evaluate func(netns uint32) string
+    if resource.Metric == MetricRPS {
+        evaluate = (&rpsTracker{}).evaluate
+    }
+    resource.monitor(ctx, containerID, collectionPeriod, swarmNodeInfo, evaluate)
+}
+
+// monitor tracks the container's namespace and scales on events from the BPF
+// program. Metrics evaluated in user space pass evaluate, which is called
+// every collection period and returns a direction to scale in, if any.
+func (resource *ConcReqResource) monitor(ctx context.Context, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo, evaluate func(netns uint32) string) {
 
     serviceID, err := scale.FindServiceIDFromContainer(containerID)
     if err != nil {
         log.Fatalf("Couldn't get service ID in ConcReqResource Monitor")
     }
 
-    netns, err := scale.GetContainerNamespace(containerID)
+    netns, releaseKey, err := trackingKey(containerID, resource.ByCgroup)
     if err != nil {
-        log.Fatalf("Couldn't get network namespace for container %s: %v", containerID, err)
+        log.Fatalf("Couldn't get tracking key for container %s: %v", containerID, err)
+    }
+
+    pid, err := scale.GetContainerPid(containerID)
+    if err != nil {
+        log.Fatalf("Couldn't get PID for container %s: %v", containerID, err)
     }
 
     ctx, cancel := context.WithCancel(ctx)
-    signal := make(chan string)
+    signal := make(chan BPFScaleEvent, 1)
 
     nsCtx := NamespaceContext{
-        Ctx:    ctx,
-        Cancel: cancel,
-        Signal: signal,
+        Ctx:         ctx,
+        Cancel:      cancel,
+        Signal:      signal,
+        ContainerID: containerID,
+        ServiceID:   serviceID,
     }
 
     addNamespace(netns, nsCtx)
+    startConcurrencyPoller(collectionPeriod, swarmNodeInfo)
+
+    ports, err := syncListenPorts(netns, pid, nil)
+    if err != nil {
+        fmt.Printf("Couldn't read listening ports for container %s: %v\n", containerID, err)
+    }
+
+    // Per-service thresholds only apply to metrics checked in the kernel
+    var config *BPFNetnsConfig
+    syncConfig := func() {
+        if resource.Metric == MetricLatency {
+            return
+        }
+        if config, err = syncNetnsConfig(*resource, netns, containerID, serviceID, swarmNodeInfo.AutoscalerManager, config); err != nil {
+            fmt.Printf("Couldn't update thresholds for container %s: %v\n", containerID, err)
+        }
+    }
+    syncConfig()
 
     cleanup := func() {
+        if config != nil {
+            listenerInstance.ConfigMap.Delete(netns)
+        }
+        for port := range ports {
+            listenerInstance.ListenPortsMap.Delete(BPFListenKey{Netns: netns, Port: port})
+        }
         if err := removeNamespace(netns); err != nil {
             fmt.Printf("Couldn't clean up BPF monitor for namespace %v\n", netns)
         }
+        releaseKey()
+        logging.RemoveContainerLog(containerID)
+    }
+
+    // While a scaling request is in flight the BPF program is disarmed for
+    // this namespace, rearmCheck fires to see whether it can be re-armed. The
+    // replicas are checked in the background, so a slow Docker or manager
+    // call doesn't hold up this loop, and the answer comes back on settledCh.
+    var rearmCheck <-chan time.Time
+    var rearmDeadline time.Time
+    rearming := false
+    settledCh := make(chan bool)
+
+    // scaleService sends the scaling request and disarms scaling until the
+    // service has its new replicas running, or the cooldown has passed
+    scaleService := func(direction string) {
+        rearmDeadline = time.Now().Add(resource.Cooldown)
+        rearmCheck = time.After(rearmPollPeriod)
+        rearming = true
+
+        if swarmNodeInfo.AutoscalerManager {
+            if err := scale.ScaleService(containerID, direction); err != nil {
+                fmt.Printf("Error scaling service for container %s: %v\n", containerID, err)
+            }
+        } else {
+            managerNode, err := server.GetManagerNode(swarmNodeInfo.OtherNodes)
+            if err != nil {
+                fmt.Printf("Error getting manager node: %v\n", err)
+                return
+            }
+
+            if err := server.SendScaleRequest(serviceID, direction, managerNode.IP); err != nil {
+                fmt.Printf("Error sending scale request to manager node: %v\n", err)
+            }
+        }
+
     }
 
+    ticker := time.NewTicker(collectionPeriod)
+    defer ticker.Stop()
+
     for {
         select {
         case <-ctx.Done():
             cleanup()
             fmt.Printf("Stopped monitoring for container %s\n", containerID)
             return
-        case threshold := <-signal:
-            var direction string
-
-            // Trim null character from eBPF program
-            threshold = strings.Trim(threshold, "\x00")
-
-            if threshold == "Lower" {
-                direction = "under"
-            } else if threshold == "Upper" {
-                direction = "over"
-            } else {
-                fmt.Printf("Invalid scaling direction.\n")
+        case <-ticker.C:
+            if ports, err = syncListenPorts(netns, pid, ports); err != nil {
+                fmt.Printf("Couldn't refresh listening ports for container %s: %v\n", containerID, err)
             }
-
-            fmt.Printf("Scale triggered for namespace %d in direction %s\n", netns, direction)
-
-            if swarmNodeInfo.AutoscalerManager {
-                if err := scale.ScaleService(containerID, direction); err != nil {
-                    fmt.Printf("Error scaling service for container %s: %v\n", containerID, err)
+            syncConfig()
+
+            if evaluate != nil {
+                // Keep evaluating while disarmed so each period only covers
+                // its own requests, but don't act on the result
+                if direction := evaluate(netns); direction != "" && !rearming {
+                    fmt.Printf("Scale triggered for namespace %d in direction %s\n", netns, direction)
+                    scaleService(direction)
                 }
-            } else {
-                managerNode, err := server.GetManagerNode(swarmNodeInfo.OtherNodes)
+            }
+        case event := <-signal:
+            direction := event.scalingDirection()
+            fmt.Printf("Scale triggered for namespace %d in direction %s at %s\n", netns, direction, event)
+            logging.AddEventLog(fmt.Sprintf("Scaling container %s %s at %s", containerID, direction, event))
+
+            scaleService(direction)
+        case <-rearmCheck:
+            rearmCheck = nil
+            go func() {
+                settled, err := replicasSettled(serviceID, swarmNodeInfo)
                 if err != nil {
-                    fmt.Printf("Error getting manager node: %v\n", err)
-                    return
+                    fmt.Printf("Couldn't check replicas of service %s: %v\n", serviceID, err)
                 }
-
-                if err := server.SendScaleRequest(serviceID, direction, managerNode.IP); err != nil {
-                    fmt.Printf("Error sending scale request to manager node: %v\n", err)
+                select {
+                case settledCh <- settled:
+                case <-ctx.Done():
                 }
+            }()
+        case settled := <-settledCh:
+            if rearmCheck != nil {
+                continue // a newer scaling request started its own checks
+            }
+            if !settled && time.Now().Before(rearmDeadline) {
+                rearmCheck = time.After(rearmPollPeriod)
+                continue
             }
 
-            // Sleep to wait for scaling then add namespace back to BPF program
-            time.Sleep(time.Second * 5)
+            if settled {
+                fmt.Printf("Replicas of service %s are running, re-arming namespace %d\n", serviceID, netns)
+            } else {
+                fmt.Printf("Cooldown passed for service %s, re-arming namespace %d\n", serviceID, netns)
+            }
+            rearming = false
             addNamespaceToScalingMap(netns)
         }
     }
@@ -0,0 +1,150 @@
+package conc_req_monitoring
+
+import (
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "logging"
+    "server"
+)
+
+// Samples older than this many collection periods are from replicas that
+// stopped or nodes that stopped reporting
+const staleSamplePeriods = 3
+
+// concurrencyStore keeps the latest sample of every replica on the manager
+type concurrencyStore struct {
+    mu      sync.Mutex
+    samples map[string]server.ConcurrencySample // containerID -> sample
+    maxAge  time.Duration
+}
+
+var (
+    concurrency     = concurrencyStore{samples: make(map[string]server.ConcurrencySample), maxAge: 30 * time.Second}
+    concurrencyOnce sync.Once
+)
+
+// RecordConcurrency stores samples from this or another node. Only called on
+// the manager.
+func RecordConcurrency(samples []server.ConcurrencySample) {
+    concurrency.mu.Lock()
+    for _, sample := range samples {
+        concurrency.samples[sample.ContainerID] = sample
+    }
+    concurrency.mu.Unlock()
+
+    for _, summary := range ConcurrencySummary() {
+        logging.AddConcurrencyLog(summary.ServiceID, summary.Connections, summary.Replicas)
+    }
+}
+
+// ConcurrencySummary adds up the latest samples of each service's replicas.
+// Services left without fresh samples are dropped from the logs.
+func ConcurrencySummary() []server.ServiceConcurrency {
+    concurrency.mu.Lock()
+    defer concurrency.mu.Unlock()
+
+    services := make(map[string]*server.ServiceConcurrency)
+    stale := make(map[string]bool)
+    for containerID, sample := range concurrency.samples {
+        if time.Since(sample.Time) > concurrency.maxAge {
+            delete(concurrency.samples, containerID)
+            stale[sample.ServiceID] = true
+            continue
+        }
+
+        summary, ok := services[sample.ServiceID]
+        if !ok {
+            summary = &server.ServiceConcurrency{ServiceID: sample.ServiceID}
+            services[sample.ServiceID] = summary
+        }
+        summary.Connections += sample.Connections
+        summary.Replicas++
+        if sample.Connections > summary.Max {
+            summary.Max = sample.Connections
+        }
+    }
+
+    for serviceID := range stale {
+        if _, ok := services[serviceID]; !ok {
+            logging.RemoveConcurrencyLog(serviceID)
+        }
+    }
+
+    summaries := make([]server.ServiceConcurrency, 0, len(services))
+    for _, summary := range services {
+        summaries = append(summaries, *summary)
+    }
+    sort.Slice(summaries, func(i, j int) bool { return summaries[i].ServiceID < summaries[j].ServiceID })
+    return summaries
+}
+
+// startConcurrencyPoller starts reading the live connection counts once the
+// first namespace is monitored
+func startConcurrencyPoller(period time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
+    concurrencyOnce.Do(func() {
+        concurrency.mu.Lock()
+        concurrency.maxAge = staleSamplePeriods * period
+        concurrency.mu.Unlock()
+
+        go pollConcurrency(period, swarmNodeInfo)
+    })
+}
+
+// pollConcurrency reads conn_count_map and buffer_map for every monitored
+// namespace each period, logs the values and reports them to the manager.
+func pollConcurrency(period time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
+    hostname, err := os.Hostname()
+    if err != nil {
+        hostname = "unknown"
+    }
+
+    ticker := time.NewTicker(period)
+    defer ticker.Stop()
+
+    for now := range ticker.C {
+        var samples []server.ConcurrencySample
+        namespaceToContext.internalMap.Range(func(key, value interface{}) bool {
+            netns, nsCtx := key.(uint32), value.(NamespaceContext)
+
+            var connections, buffer uint32
+            if err := listenerInstance.ConnCountMap.Lookup(netns, &connections); err != nil {
+                return true // namespace removed since the range started
+            }
+            // buffer_map only has an entry once a threshold was crossed
+            listenerInstance.BufferMap.Lookup(netns, &buffer)
+
+            logging.AddContainerLog(nsCtx.ContainerID, float64(connections))
+            samples = append(samples, server.ConcurrencySample{
+                ServiceID:   nsCtx.ServiceID,
+                ContainerID: nsCtx.ContainerID,
+                Node:        hostname,
+                Connections: connections,
+                Buffer:      buffer,
+                Time:        now,
+            })
+            return true
+        })
+
+        if len(samples) == 0 {
+            continue
+        }
+
+        if swarmNodeInfo.AutoscalerManager {
+            RecordConcurrency(samples)
+            continue
+        }
+
+        managerNode, err := server.GetManagerNode(swarmNodeInfo.OtherNodes)
+        if err != nil {
+            fmt.Printf("Error getting manager node: %v\n", err)
+            continue
+        }
+        if err := server.SendMetrics(samples, managerNode.IP); err != nil {
+            fmt.Printf("Error sending metrics to manager node: %v\n", err)
+        }
+    }
+}
@@ -4,7 +4,7 @@ require (
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/sys v0.20.0
 )
 
 require server v0.0.0
@@ -37,7 +37,6 @@ require (
 	go.opentelemetry.io/proto/otlp v1.2.0 // indirect
 	google.golang.org/grpc v1.64.0 // indirect
 	google.golang.org/protobuf v1.34.1 // indirect
-	logging v0.0.0 // indirect
 )
 
 replace logging => ../logging
@@ -49,3 +48,14 @@ require scale v0.0.0
 replace scale => ../scale
 
 go 1.21.9
+
+require (
+	bpf_events v0.0.0
+	logging v0.0.0
+)
+
+replace bpf_events => ../bpf_events
+
+require cgroup_monitoring v0.0.0
+
+replace cgroup_monitoring => ../cgroup_monitoring
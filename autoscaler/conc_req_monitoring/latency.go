@@ -0,0 +1,121 @@
+package conc_req_monitoring
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "time"
+
+    "server"
+)
+
+// LatencyResource scales on a percentile of the time between the application
+// reading a request and sending the first byte of its response. The kernel
+// only keeps histograms, the percentile is worked out every collection period.
+type LatencyResource struct {
+    Percentile   float64 // e.g. 95 or 99
+    LowerMs      float64 // scale down below this latency, negative to disable
+    UpperMs      float64 // scale up above this latency, negative to disable
+    BufferLength int64   // consecutive periods outside the thresholds before scaling
+    Cooldown     time.Duration
+    ByCgroup     bool // count per container cgroup instead of per network namespace
+}
+
+// ListenerResource returns the settings for InitBPFListener. Latency
+// thresholds are not checked in the kernel.
+func (resource *LatencyResource) ListenerResource() ConcReqResource {
+    return ConcReqResource{LowerLimit: -1, UpperLimit: -1, BufferLength: resource.BufferLength, Metric: MetricLatency, Cooldown: resource.Cooldown, ByCgroup: resource.ByCgroup}
+}
+
+func (resource *LatencyResource) Monitor(ctx context.Context, containerID string, collectionPeriod time.Duration, swarmNodeInfo *server.SwarmNodeInfo) {
+    tracker := &latencyTracker{resource: resource}
+    listener := resource.ListenerResource()
+    listener.monitor(ctx, containerID, collectionPeriod, swarmNodeInfo, tracker.evaluate)
+}
+
+// latencyTracker keeps the histogram from the previous period of one
+// namespace, so each evaluation only sees the requests since then.
+type latencyTracker struct {
+    resource *LatencyResource
+    prev     BPFLatencyHist
+    primed   bool
+    buffer   int64
+}
+
+func (tracker *latencyTracker) evaluate(netns uint32) string {
+    var hist BPFLatencyHist
+    if err := listenerInstance.LatencyHistMap.Lookup(netns, &hist); err != nil {
+        fmt.Printf("Couldn't read latency histogram for namespace %d: %v\n", netns, err)
+        return ""
+    }
+
+    var period BPFLatencyHist
+    for i := range hist.Slots {
+        period.Slots[i] = hist.Slots[i] - tracker.prev.Slots[i]
+    }
+    tracker.prev = hist
+    if !tracker.primed {
+        tracker.primed = true
+        return ""
+    }
+
+    latencyMs, ok := percentile(period, tracker.resource.Percentile)
+    if !ok {
+        // No requests, so nothing to judge the latency on
+        tracker.buffer = 0
+        return ""
+    }
+
+    var direction string
+    if tracker.resource.UpperMs >= 0 && latencyMs > tracker.resource.UpperMs {
+        direction = "over"
+    } else if tracker.resource.LowerMs >= 0 && latencyMs < tracker.resource.LowerMs {
+        direction = "under"
+    }
+    if direction == "" {
+        tracker.buffer = 0
+        return ""
+    }
+
+    tracker.buffer++
+    if tracker.buffer < tracker.resource.BufferLength {
+        return ""
+    }
+    tracker.buffer = 0
+
+    fmt.Printf("p%g latency for namespace %d is %.2fms\n", tracker.resource.Percentile, netns, latencyMs)
+    return direction
+}
+
+// percentile returns the latency in milliseconds below which p percent of the
+// requests in the histogram completed, interpolating linearly inside the
+// log2 slot it falls in. ok is false if the histogram is empty.
+func percentile(hist BPFLatencyHist, p float64) (float64, bool) {
+    var total uint64
+    for _, count := range hist.Slots {
+        total += count
+    }
+    if total == 0 {
+        return 0, false
+    }
+
+    rank := p / 100 * float64(total)
+    var seen uint64
+    for i, count := range hist.Slots {
+        if count == 0 || float64(seen+count) < rank {
+            seen += count
+            continue
+        }
+
+        // Slot i holds [2^i, 2^(i+1)) microseconds, slot 0 starts at zero
+        low := math.Exp2(float64(i))
+        if i == 0 {
+            low = 0
+        }
+        high := math.Exp2(float64(i + 1))
+        fraction := (rank - float64(seen)) / float64(count)
+        return (low + fraction*(high-low)) / 1000, true
+    }
+
+    return math.Exp2(float64(len(hist.Slots))) / 1000, true
+}
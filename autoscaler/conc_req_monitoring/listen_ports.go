@@ -0,0 +1,82 @@
+package conc_req_monitoring
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+
+    "scale"
+)
+
+const tcpListenState = "0A" // TCP_LISTEN as printed in /proc/net/tcp
+
+// listeningPorts returns the TCP ports the process is listening on inside its
+// network namespace, read from /proc/<pid>/net/tcp and tcp6.
+func listeningPorts(pid int) (map[uint16]bool, error) {
+    ports := make(map[uint16]bool)
+
+    for _, file := range []string{"tcp", "tcp6"} {
+        content, err := os.ReadFile(fmt.Sprintf("%s/%d/net/%s", scale.ProcRoot(), pid, file))
+        if err != nil {
+            if os.IsNotExist(err) && file == "tcp6" {
+                continue // IPv6 disabled
+            }
+            return nil, err
+        }
+
+        lines := strings.Split(string(content), "\n")
+        for _, line := range lines[1:] { // skip header
+            fields := strings.Fields(line)
+            if len(fields) < 4 || fields[3] != tcpListenState {
+                continue
+            }
+
+            // local_address is ADDR:PORT with the port in hex
+            _, portHex, found := strings.Cut(fields[1], ":")
+            if !found {
+                continue
+            }
+            port, err := strconv.ParseUint(portHex, 16, 16)
+            if err != nil {
+                continue
+            }
+            ports[uint16(port)] = true
+        }
+    }
+
+    return ports, nil
+}
+
+// syncListenPorts updates listen_ports_map so it matches the ports the
+// container currently listens on. Services often bind after the container
+// starts, so this runs on every collection period.
+func syncListenPorts(netns uint32, pid int, current map[uint16]bool) (map[uint16]bool, error) {
+    ports, err := listeningPorts(pid)
+    if err != nil {
+        return current, err
+    }
+
+    for port := range ports {
+        if current[port] {
+            continue
+        }
+        key := BPFListenKey{Netns: netns, Port: port}
+        if err := listenerInstance.ListenPortsMap.Put(key, uint8(1)); err != nil {
+            return current, fmt.Errorf("adding port %d to ListenPortsMap: %v", port, err)
+        }
+        fmt.Printf("Counting connections on port %d in namespace %d\n", port, netns)
+    }
+
+    for port := range current {
+        if ports[port] {
+            continue
+        }
+        key := BPFListenKey{Netns: netns, Port: port}
+        if err := listenerInstance.ListenPortsMap.Delete(key); err != nil {
+            fmt.Printf("Failed to delete port %d from ListenPortsMap: %v\n", port, err)
+        }
+    }
+
+    return ports, nil
+}
@@ -0,0 +1,145 @@
+package conc_req_monitoring
+
+import (
+    "fmt"
+
+    "github.com/cilium/ebpf"
+    "github.com/cilium/ebpf/btf"
+    "github.com/cilium/ebpf/link"
+)
+
+// Attachment modes of the request probes
+const (
+    attachFentry = "fentry"
+    attachKprobe = "kprobe"
+)
+
+// requestProbe is a kernel function followed by the request probes, with the
+// program used for it in each attachment mode. A program name is empty if
+// that mode needs no program there.
+type requestProbe struct {
+    symbol    string
+    fentry    string // fentry or fexit program
+    kprobe    string // kprobe or kretprobe program
+    onReturn  bool
+    argsConst string // constant set to the argument count of an fexit program's function
+}
+
+// fexit sees both the arguments and the return value of tcp_recvmsg, a
+// kretprobe only sees the return value, so the kprobe remembers the socket.
+var requestProbes = []requestProbe{
+    {symbol: "inet_csk_accept", fentry: "fexit_inet_csk_accept", kprobe: "kretprobe_inet_csk_accept", onReturn: true, argsConst: "accept_args"},
+    {symbol: "tcp_recvmsg", fentry: "fexit_tcp_recvmsg", kprobe: "kprobe_tcp_recvmsg", argsConst: "recvmsg_args"},
+    {symbol: "tcp_recvmsg", kprobe: "kretprobe_tcp_recvmsg", onReturn: true},
+    {symbol: "tcp_sendmsg", fentry: "fentry_tcp_sendmsg", kprobe: "kprobe_tcp_sendmsg"},
+}
+
+// fexitConstants sets the argument counts the fexit programs need to find
+// the return value, which follows the arguments. It is read from the kernel
+// BTF rather than with bpf_get_func_ret, which needs 5.17.
+func fexitConstants(constants map[string]interface{}) {
+    for _, probe := range requestProbes {
+        if probe.argsConst == "" {
+            continue
+        }
+        args, err := funcArgCount(probe.symbol)
+        if err != nil {
+            // Without BTF there is no fexit either, the kprobes don't need it
+            fmt.Printf("Couldn't read the arguments of %s: %v\n", probe.symbol, err)
+            continue
+        }
+        constants[probe.argsConst] = uint32(args)
+    }
+}
+
+// funcArgCount returns the number of arguments of a kernel function from the
+// kernel BTF
+func funcArgCount(symbol string) (int, error) {
+    spec, err := btf.LoadKernelSpec()
+    if err != nil {
+        return 0, err
+    }
+
+    var fn *btf.Func
+    if err := spec.TypeByName(symbol, &fn); err != nil {
+        return 0, err
+    }
+    proto, ok := fn.Type.(*btf.FuncProto)
+    if !ok {
+        return 0, fmt.Errorf("%s has no function prototype", symbol)
+    }
+    return len(proto.Params), nil
+}
+
+// listenerObjects are the maps and programs loaded in every attachment mode
+type listenerObjects struct {
+    BPFMaps
+    TracepointInetSockSetState *ebpf.Program `ebpf:"tracepoint_inet_sock_set_state"`
+}
+
+// loadCollection loads the BPF objects. The request probes are loaded as
+// fentry/fexit programs, which read typed arguments from BTF, and fall back
+// to kprobes on kernels without BPF trampolines (before 5.5). The other set is
+// left out of the collection. mode is empty if the probes aren't needed.
+func loadCollection(spec *ebpf.CollectionSpec, opts ebpf.CollectionOptions, withRequestProbes bool) (coll *ebpf.Collection, mode string, err error) {
+    var fentryPrograms, kprobePrograms []string
+    for _, probe := range requestProbes {
+        if probe.fentry != "" {
+            fentryPrograms = append(fentryPrograms, probe.fentry)
+        }
+        if probe.kprobe != "" {
+            kprobePrograms = append(kprobePrograms, probe.kprobe)
+        }
+    }
+
+    if !withRequestProbes {
+        coll, err = loadWithout(spec, opts, append(fentryPrograms, kprobePrograms...))
+        return coll, "", err
+    }
+
+    if coll, err = loadWithout(spec, opts, kprobePrograms); err == nil {
+        return coll, attachFentry, nil
+    }
+    fmt.Printf("Couldn't load fentry programs, falling back to kprobes: %v\n", err)
+
+    coll, err = loadWithout(spec, opts, fentryPrograms)
+    return coll, attachKprobe, err
+}
+
+func loadWithout(spec *ebpf.CollectionSpec, opts ebpf.CollectionOptions, programs []string) (*ebpf.Collection, error) {
+    spec = spec.Copy()
+    for _, name := range programs {
+        delete(spec.Programs, name)
+    }
+    return ebpf.NewCollectionWithOptions(spec, opts)
+}
+
+// attachRequestProbes attaches the probes that follow individual requests on
+// accepted sockets. They run on every recvmsg and sendmsg, so they are only
+// loaded when a per-request metric is configured.
+func attachRequestProbes(coll *ebpf.Collection, mode string) ([]link.Link, error) {
+    var links []link.Link
+    for _, probe := range requestProbes {
+        var l link.Link
+        var err error
+        switch {
+        case mode == attachFentry && probe.fentry == "", mode == attachKprobe && probe.kprobe == "":
+            continue
+        case mode == attachFentry:
+            l, err = link.AttachTracing(link.TracingOptions{Program: coll.Programs[probe.fentry]})
+        case probe.onReturn:
+            l, err = link.Kretprobe(probe.symbol, coll.Programs[probe.kprobe], nil)
+        default:
+            l, err = link.Kprobe(probe.symbol, coll.Programs[probe.kprobe], nil)
+        }
+        if err != nil {
+            for _, attached := range links {
+                attached.Close()
+            }
+            return nil, fmt.Errorf("attaching %s program to %s: %v", mode, probe.symbol, err)
+        }
+        links = append(links, l)
+    }
+
+    return links, nil
+}
@@ -0,0 +1,33 @@
+package conc_req_monitoring
+
+import (
+    "time"
+
+    "scale"
+    "server"
+)
+
+// How often the replicas are checked after a scaling request
+const rearmPollPeriod = time.Second
+
+// replicasSettled reports whether every desired replica of the service is
+// running, asking the manager when called on a worker
+func replicasSettled(serviceID string, swarmNodeInfo *server.SwarmNodeInfo) (bool, error) {
+    var status server.ReplicaStatus
+    var err error
+
+    if swarmNodeInfo.AutoscalerManager {
+        status, err = scale.GetServiceReplicas(serviceID)
+    } else {
+        var managerNode server.SwarmNode
+        if managerNode, err = server.GetManagerNode(swarmNodeInfo.OtherNodes); err != nil {
+            return false, err
+        }
+        status, err = server.SendReplicasRequest(serviceID, managerNode.IP)
+    }
+    if err != nil {
+        return false, err
+    }
+
+    return status.Running == status.Desired, nil
+}
@@ -0,0 +1,94 @@
+package conc_req_monitoring
+
+import (
+    "fmt"
+
+    "golang.org/x/sys/unix"
+)
+
+// Length of the sliding window the BPF program counts requests in,
+// RPS_WINDOW_NS in bpf/conc_req_monitoring.c
+const rpsWindowNs = uint64(1e9)
+
+// Metric selects which value the BPF program compares with the thresholds,
+// it must match enum metric in bpf/conc_req_monitoring.c
+type Metric uint32
+
+const (
+    MetricConnections Metric = iota // established connections
+    MetricRPS                       // requests per second
+    MetricLatency                   // request latency, evaluated in user space
+)
+
+// monotonicNow returns the clock used by bpf_ktime_get_ns
+func monotonicNow() uint64 {
+    var ts unix.Timespec
+    if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+        return 0
+    }
+    return uint64(ts.Nano())
+}
+
+// rpsAt estimates the requests over the second before now from a window
+// counted by the BPF program, the same way the window rolls over when a
+// request arrives. Reading it every period lets the rate fall to zero once
+// requests stop.
+func rpsAt(window BPFRpsWindow, now uint64) uint32 {
+    if now < window.WindowStartNs {
+        now = window.WindowStartNs
+    }
+    elapsed := now - window.WindowStartNs
+    if elapsed >= 2*rpsWindowNs {
+        return 0
+    }
+    if elapsed >= rpsWindowNs {
+        window.PrevCount = window.CurrCount
+        window.CurrCount = 0
+        elapsed -= rpsWindowNs
+    }
+    return uint32(uint64(window.PrevCount)*(rpsWindowNs-elapsed)/rpsWindowNs) + window.CurrCount
+}
+
+// rpsTracker compares the request rate of one namespace with its thresholds
+// every collection period, so req-buffer-length counts periods
+type rpsTracker struct {
+    buffer uint32
+}
+
+func (tracker *rpsTracker) evaluate(netns uint32) string {
+    var window BPFRpsWindow
+    if err := listenerInstance.RPSMap.Lookup(netns, &window); err != nil {
+        fmt.Printf("Couldn't read request rate for namespace %d: %v\n", netns, err)
+        return ""
+    }
+
+    // The namespace's own thresholds, or the node-wide ones
+    var config BPFNetnsConfig
+    if err := listenerInstance.ConfigMap.Lookup(netns, &config); err != nil {
+        if err := listenerInstance.ConfigMap.Lookup(uint32(0), &config); err != nil {
+            fmt.Printf("Couldn't read thresholds for namespace %d: %v\n", netns, err)
+            return ""
+        }
+    }
+
+    rps := rpsAt(window, monotonicNow())
+    var direction string
+    if config.UpperLimit != thresholdDisabled && rps >= config.UpperLimit {
+        direction = "over"
+    } else if config.LowerLimit != thresholdDisabled && rps <= config.LowerLimit {
+        direction = "under"
+    }
+    if direction == "" {
+        tracker.buffer = 0
+        return ""
+    }
+
+    tracker.buffer++
+    if tracker.buffer < config.BufferLength {
+        return ""
+    }
+    tracker.buffer = 0
+
+    fmt.Printf("Request rate for namespace %d is %d req/s (limits %d-%d)\n", netns, rps, config.LowerLimit, config.UpperLimit)
+    return direction
+}
@@ -0,0 +1,67 @@
+package conc_req_monitoring
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+)
+
+// decodeScaleEvent parses an event from the BPF program and checks it is
+// consistent, so a malformed event can never trigger scaling.
+func decodeScaleEvent(sample []byte) (BPFScaleEvent, error) {
+    var event BPFScaleEvent
+    if len(sample) < binary.Size(event) {
+        return event, fmt.Errorf("event is %d bytes, expected %d", len(sample), binary.Size(event))
+    }
+    if err := binary.Read(bytes.NewReader(sample), binary.NativeEndian, &event); err != nil {
+        return event, err
+    }
+
+    if event.Netns == 0 {
+        return event, fmt.Errorf("event has no network namespace")
+    }
+    if event.BufferLength == 0 || event.Buffer < event.BufferLength {
+        return event, fmt.Errorf("event sent after %d of %d samples", event.Buffer, event.BufferLength)
+    }
+
+    switch event.Direction {
+    case BPFScaleDirectionSCALE_DOWN:
+        if event.LowerLimit == thresholdDisabled || event.Value > event.LowerLimit {
+            return event, fmt.Errorf("scale down event with value %d above lower limit %d", event.Value, event.LowerLimit)
+        }
+    case BPFScaleDirectionSCALE_UP:
+        if event.UpperLimit == thresholdDisabled || event.Value < event.UpperLimit {
+            return event, fmt.Errorf("scale up event with value %d below upper limit %d", event.Value, event.UpperLimit)
+        }
+    default:
+        return event, fmt.Errorf("invalid scaling direction %d", event.Direction)
+    }
+
+    return event, nil
+}
+
+// scalingDirection returns the direction in the form used by the scale package
+func (event BPFScaleEvent) scalingDirection() string {
+    if event.Direction == BPFScaleDirectionSCALE_DOWN {
+        return "under"
+    }
+    return "over"
+}
+
+// String describes the value that caused the event, e.g. "12 connections
+// (limits 3-10)"
+func (event BPFScaleEvent) String() string {
+    unit := "connections"
+    if Metric(event.Metric) == MetricRPS {
+        unit = "req/s"
+    }
+
+    limit := func(value uint32) string {
+        if value == thresholdDisabled {
+            return "none"
+        }
+        return fmt.Sprint(value)
+    }
+
+    return fmt.Sprintf("%d %s (limits %s-%s, %d samples)", event.Value, unit, limit(event.LowerLimit), limit(event.UpperLimit), event.Buffer)
+}
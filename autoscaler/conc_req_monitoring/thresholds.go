@@ -0,0 +1,99 @@
+package conc_req_monitoring
+
+import (
+    "fmt"
+    "strconv"
+
+    "scale"
+)
+
+const thresholdDisabled = 0xFFFFFFFF // THRESHOLD_DISABLED
+
+// Labels that override the node-wide thresholds for a service. They can be
+// set on the container, or on the service where a manager can read them, and
+// the service labels win.
+const (
+    lowerConcReqLabel    = "autoscaler.lowerConcReq"
+    upperConcReqLabel    = "autoscaler.upperConcReq"
+    lowerRPSLabel        = "autoscaler.lowerRPS"
+    upperRPSLabel        = "autoscaler.upperRPS"
+    reqBufferLengthLabel = "autoscaler.reqBufferLength"
+)
+
+// configFor converts the resource into the config_map value. Negative limits
+// disable the threshold.
+func configFor(resource ConcReqResource) BPFNetnsConfig {
+    limit := func(value int64) uint32 {
+        if value < 0 {
+            return thresholdDisabled
+        }
+        return uint32(value)
+    }
+
+    return BPFNetnsConfig{
+        LowerLimit:   limit(resource.LowerLimit),
+        UpperLimit:   limit(resource.UpperLimit),
+        BufferLength: uint32(resource.BufferLength),
+        Metric:       uint32(resource.Metric),
+    }
+}
+
+// withLabels returns a copy of the resource with any per-service thresholds
+// applied, and whether any label was found.
+func (resource ConcReqResource) withLabels(labels map[string]string) (ConcReqResource, bool) {
+    lowerLabel, upperLabel := lowerConcReqLabel, upperConcReqLabel
+    if resource.Metric == MetricRPS {
+        lowerLabel, upperLabel = lowerRPSLabel, upperRPSLabel
+    }
+
+    overridden := false
+    parseInt := func(label string, field *int64) {
+        if value, ok := labels[label]; ok {
+            if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+                *field = parsed
+                overridden = true
+            } else {
+                fmt.Printf("Ignoring invalid %s label %q: %v\n", label, value, err)
+            }
+        }
+    }
+    parseInt(lowerLabel, &resource.LowerLimit)
+    parseInt(upperLabel, &resource.UpperLimit)
+    parseInt(reqBufferLengthLabel, &resource.BufferLength)
+
+    return resource, overridden
+}
+
+// syncNetnsConfig writes the thresholds of the container's service into
+// config_map, or removes its entry so the node-wide thresholds apply. Service
+// labels can be changed with `docker service update --label-add`, so this
+// runs on every collection period, with the labels cached by the scale
+// package until the service is updated.
+func syncNetnsConfig(resource ConcReqResource, netns uint32, containerID, serviceID string, manager bool, current *BPFNetnsConfig) (*BPFNetnsConfig, error) {
+    labels, err := scale.GetScalingLabels(containerID, serviceID, manager)
+    if err != nil {
+        return current, err
+    }
+
+    resource, overridden := resource.withLabels(labels)
+    if !overridden {
+        if current != nil {
+            if err := listenerInstance.ConfigMap.Delete(netns); err != nil {
+                return current, fmt.Errorf("deleting namespace %d from ConfigMap: %v", netns, err)
+            }
+            fmt.Printf("Using node thresholds for namespace %d\n", netns)
+        }
+        return nil, nil
+    }
+
+    config := configFor(resource)
+    if current != nil && *current == config {
+        return current, nil
+    }
+    if err := listenerInstance.ConfigMap.Put(netns, config); err != nil {
+        return current, fmt.Errorf("adding namespace %d to ConfigMap: %v", netns, err)
+    }
+    fmt.Printf("Using thresholds lower %d, upper %d, buffer %d for namespace %d\n", resource.LowerLimit, resource.UpperLimit, resource.BufferLength, netns)
+
+    return &config, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/olekukonko/tablewriter"
@@ -20,9 +21,19 @@ type ScalingLog struct {
 	Direction string
 }
 
+type ConcurrencyLog struct {
+	Connections uint32
+	Replicas    int
+}
+
+// logsMu guards the logs below, which are added to from many goroutines
+var logsMu sync.Mutex
+
 var containerLogs = make(map[string]float64)
 var serviceLogs = make(map[string]uint32)
-var bpfListenerLogs = make(map[uint32]string)
+var bpfListenerLogs = make(map[string]string)
+var bpfEventLossLogs = make(map[string]uint64)
+var concurrencyLogs = make(map[string]ConcurrencyLog)
 var eventLogs = []EventLog{}
 
 
@@ -45,10 +56,14 @@ func AddScalingLog(direction string) {
 }
 
 func AddContainerLog(containerId string, util float64) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	containerLogs[containerId] = util
 }
 
 func RemoveContainerLog(containerId string) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	if _, ok := containerLogs[containerId]; !ok {
 		return
 	}
@@ -57,10 +72,14 @@ func RemoveContainerLog(containerId string) {
 }
 
 func AddServiceLog(serviceId string, replicas uint32) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	serviceLogs[serviceId] = replicas
 }
 
 func RemoveServiceLog(serviceId string) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	if _, ok := serviceLogs[serviceId]; !ok {
 		return
 	}
@@ -68,11 +87,15 @@ func RemoveServiceLog(serviceId string) {
 	delete(serviceLogs, serviceId)
 }
 
-func AddBPFListenerLog(serviceId string, port uint32) {
+func AddBPFListenerLog(serviceId string, port string) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	bpfListenerLogs[port] = serviceId
 }
 
-func RemoveBPFListenerLog(port uint32) {
+func RemoveBPFListenerLog(port string) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	if _, ok := bpfListenerLogs[port]; !ok {
 		return
 	}
@@ -80,8 +103,32 @@ func RemoveBPFListenerLog(port uint32) {
 	delete(bpfListenerLogs, port)	
 }
 
+func AddConcurrencyLog(serviceId string, connections uint32, replicas int) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	concurrencyLogs[serviceId] = ConcurrencyLog{connections, replicas}
+}
+
+func RemoveConcurrencyLog(serviceId string) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	if _, ok := concurrencyLogs[serviceId]; !ok {
+		return
+	}
+
+	delete(concurrencyLogs, serviceId)
+}
+
+func AddBPFEventLossLog(program string, lost uint64) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	bpfEventLossLogs[program] = lost
+}
+
 func AddEventLog(event string) {
 	fmt.Println(event)
+	logsMu.Lock()
+	defer logsMu.Unlock()
 	eventLogs = append(eventLogs, EventLog{Event: event})
 }
 
@@ -107,6 +154,9 @@ func WriteLogs(events bool) {
 
 	defer logFile.Close()
 
+	logsMu.Lock()
+	defer logsMu.Unlock()
+
 	table := tablewriter.NewWriter(logFile)
 	table.SetHeader([]string{"Container ID", "Utilization"})
 	for containerId, util := range containerLogs {
@@ -124,7 +174,21 @@ func WriteLogs(events bool) {
 	table = tablewriter.NewWriter(logFile)
 	table.SetHeader([]string{"Service ID", "Port"})
 	for port, serviceId := range bpfListenerLogs {
-		table.Append([]string{serviceId, strconv.Itoa(int(port))})
+		table.Append([]string{serviceId, port})
+	}
+	table.Render()
+
+	table = tablewriter.NewWriter(logFile)
+	table.SetHeader([]string{"Service ID", "Connections", "Replicas"})
+	for serviceId, log := range concurrencyLogs {
+		table.Append([]string{serviceId, strconv.FormatUint(uint64(log.Connections), 10), strconv.Itoa(log.Replicas)})
+	}
+	table.Render()
+
+	table = tablewriter.NewWriter(logFile)
+	table.SetHeader([]string{"BPF Program", "Lost Events"})
+	for program, lost := range bpfEventLossLogs {
+		table.Append([]string{program, strconv.FormatUint(lost, 10)})
 	}
 	table.Render()
 
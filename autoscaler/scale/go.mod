@@ -28,7 +28,6 @@ require (
 	go.opentelemetry.io/otel/metric v1.25.0 // indirect
 	go.opentelemetry.io/otel/sdk v1.25.0 // indirect
 	go.opentelemetry.io/otel/trace v1.25.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 	gotest.tools/v3 v3.5.1 // indirect
 )
@@ -37,6 +36,9 @@ require server v0.0.0
 
 replace server => ../server
 
-require logging v0.0.0
+require (
+	golang.org/x/sys v0.18.0
+	logging v0.0.0
+)
 
 replace logging => ../logging
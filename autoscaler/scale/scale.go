@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"logging"
 	"os"
+	"regexp"
 	"server"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
@@ -19,9 +23,29 @@ import (
 )
 
 type PortListener interface {
-	ListenOnPort(port uint32, serviceID string) error
+	ListenOnPort(port server.PublishedPort, serviceID string) error
+	ListenOnVIP(vip string, serviceID string) error
+	ListenOnHost(host string, serviceID string) error
+	RemovePort(port server.PublishedPort) error
+	RemoveVIP(vip string) error
+	RemoveHost(host string) error
 }
 
+// Label listing the hostnames, comma separated, a service is reached by
+// through a shared reverse proxy. Without it the hosts in the service's
+// Traefik Host and HostSNI router rules are used.
+const hostsLabel = "autoscaler.hosts"
+
+// Label opting a service into being woken from 0 by connections to its VIPs.
+// Only connections from this node's processes are seen, so a service others
+// reach some other way would not be woken.
+const wakeOnVIPLabel = "autoscaler.wakeOnVIP"
+
+var (
+	traefikHostRule = regexp.MustCompile(`\bHost(?:SNI)?\(([^)]*)\)`)
+	quotedValue     = regexp.MustCompile("[`\"]([^`\"]*)[`\"]")
+)
+
 type ScaleManager struct {
 	cli          *client.Client
 	portListener PortListener
@@ -32,6 +56,42 @@ type ScaleManager struct {
 var instance *ScaleManager
 var once sync.Once
 
+// How long the labels of a service are cached for GetScalingLabels. Updates
+// seen in the Docker events drop them sooner, this only covers missed events.
+const ServiceLabelsTTL = 5 * time.Minute
+
+type cachedLabels struct {
+	labels  map[string]string
+	fetched time.Time
+}
+
+var (
+	serviceUpdateMu       sync.Mutex
+	serviceUpdateHandlers []func(serviceID string)
+)
+
+// OnServiceUpdate calls fn with the ID of every service updated or removed,
+// once its cached labels are dropped, so the caller can read them again.
+// fn must not block.
+func OnServiceUpdate(fn func(serviceID string)) {
+	serviceUpdateMu.Lock()
+	defer serviceUpdateMu.Unlock()
+	serviceUpdateHandlers = append(serviceUpdateHandlers, fn)
+}
+
+func notifyServiceUpdate(serviceID string) {
+	serviceUpdateMu.Lock()
+	defer serviceUpdateMu.Unlock()
+	for _, fn := range serviceUpdateHandlers {
+		fn(serviceID)
+	}
+}
+
+var (
+	containerLabelsCache sync.Map // containerID -> map[string]string
+	serviceLabelsCache   sync.Map // serviceID -> cachedLabels
+)
+
 func GetScaler() *ScaleManager {
 	once.Do(func() {
 		instance = &ScaleManager{}
@@ -76,15 +136,13 @@ func ScaleService(containerID string, direction string) error {
 
 // FindServiceIDFromContainer inspects the container to find its associated service ID.
 func FindServiceIDFromContainer(containerID string) (string, error) {
-	ctx := context.Background()
-	cli := instance.cli
-	container, err := cli.ContainerInspect(ctx, containerID)
+	labels, err := GetContainerLabels(containerID)
 	if err != nil {
 		return "", err
 	}
 
 	// Retrieve the service ID from the container's labels
-	serviceID, ok := container.Config.Labels["com.docker.swarm.service.id"]
+	serviceID, ok := labels["com.docker.swarm.service.id"]
 	if !ok {
 		return "", fmt.Errorf("service ID label not found on container")
 	}
@@ -92,6 +150,87 @@ func FindServiceIDFromContainer(containerID string) (string, error) {
 	return serviceID, nil
 }
 
+// GetContainerLabels returns the labels of a container. Unlike service labels
+// these can be read on worker nodes too.
+func GetContainerLabels(containerID string) (map[string]string, error) {
+	ctx := context.Background()
+	cli := instance.cli
+	container, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return container.Config.Labels, nil
+}
+
+// GetServiceLabels returns the labels of a service. Only works on manager
+// nodes, and unlike container labels they can change while the service runs.
+func GetServiceLabels(serviceID string) (map[string]string, error) {
+	ctx := context.Background()
+	cli := instance.cli
+	service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return service.Spec.Labels, nil
+}
+
+// GetScalingLabels returns the labels that configure scaling of a container.
+// Managers merge in the labels of its service, which win over the container
+// labels, so `docker service update --label-add` takes effect without
+// redeploying the service. Monitors call this every collection period, so
+// the labels are cached rather than inspected each time.
+func GetScalingLabels(containerID, serviceID string, manager bool) (map[string]string, error) {
+	labels, err := cachedContainerLabels(containerID)
+	if err != nil || !manager {
+		return labels, err
+	}
+
+	serviceLabels, err := cachedServiceLabels(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]string, len(labels)+len(serviceLabels))
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range serviceLabels {
+		merged[key] = value
+	}
+	return merged, nil
+}
+
+// cachedContainerLabels returns the labels of a container, which can't change
+// while it exists. They are dropped once it dies.
+func cachedContainerLabels(containerID string) (map[string]string, error) {
+	if labels, ok := containerLabelsCache.Load(containerID); ok {
+		return labels.(map[string]string), nil
+	}
+
+	labels, err := GetContainerLabels(containerID)
+	if err != nil {
+		return nil, err
+	}
+	containerLabelsCache.Store(containerID, labels)
+	return labels, nil
+}
+
+// cachedServiceLabels returns the labels of a service, inspecting it again
+// once it was updated or the cached labels are older than ServiceLabelsTTL
+func cachedServiceLabels(serviceID string) (map[string]string, error) {
+	if cached, ok := serviceLabelsCache.Load(serviceID); ok && time.Since(cached.(cachedLabels).fetched) < ServiceLabelsTTL {
+		return cached.(cachedLabels).labels, nil
+	}
+
+	labels, err := GetServiceLabels(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	serviceLabelsCache.Store(serviceID, cachedLabels{labels: labels, fetched: time.Now()})
+	return labels, nil
+}
+
 func updateServiceConstraints(service swarm.Service, add bool) error {
 	ctx := context.Background()
 	cli := instance.cli
@@ -192,6 +331,44 @@ func ChangeServiceReplicas(serviceID string, direction string) error {
 	return scaleTo(serviceID, newReplicas)
 }
 
+// GetServiceReplicas returns how many replicas the service should have and
+// how many of them are running. Only works on manager nodes.
+func GetServiceReplicas(serviceID string) (server.ReplicaStatus, error) {
+	ctx := context.Background()
+	cli := instance.cli
+
+	service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return server.ReplicaStatus{}, err
+	}
+	if service.Spec.Mode.Replicated == nil || service.Spec.Mode.Replicated.Replicas == nil {
+		return server.ReplicaStatus{}, fmt.Errorf("service mode is not replicated or replicas are not set")
+	}
+
+	tasks, err := cli.TaskList(ctx, types.TaskListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("service", serviceID),
+			filters.Arg("desired-state", "running"),
+		),
+	})
+	if err != nil {
+		return server.ReplicaStatus{}, err
+	}
+
+	status := server.ReplicaStatus{Desired: *service.Spec.Mode.Replicated.Replicas}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning {
+			status.Running++
+		}
+	}
+
+	return status, nil
+}
+
+func (s *ScaleManager) ServiceReplicas(serviceID string) (server.ReplicaStatus, error) {
+	return GetServiceReplicas(serviceID)
+}
+
 func (s *ScaleManager) ScaleTo(serviceID string, replicas uint64) error {
 	return scaleTo(serviceID, replicas)
 }
@@ -222,24 +399,97 @@ func scaleTo(serviceID string, replicas uint64) error {
 	return nil
 }
 
-func GetPublishedPort(serviceID string) (uint32, error) {
+// GetPublishedPorts returns every port the service publishes, traffic on any
+// of them should wake it from zero. Services reached only through their VIPs
+// or hostnames have none.
+func GetPublishedPorts(serviceID string) ([]server.PublishedPort, error) {
 	ctx := context.Background()
 	cli := instance.cli
 
 	service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	var publishedPort uint32
-	if len(service.Endpoint.Ports) > 0 {
-		// Assuming we are interested in the first port
-		publishedPort = service.Endpoint.Ports[0].PublishedPort
-	} else {
-		return 0, fmt.Errorf("no published ports found for service %s", serviceID)
+	publishedPorts := make([]server.PublishedPort, 0, len(service.Endpoint.Ports))
+	for _, port := range service.Endpoint.Ports {
+		publishedPorts = append(publishedPorts, server.PublishedPort{Port: port.PublishedPort, Protocol: string(port.Protocol)})
+	}
+
+	return publishedPorts, nil
+}
+
+// GetServiceVIPs returns the service's virtual IPs on its networks, which
+// other services connect to. Services without the wakeOnVIPLabel have none.
+func GetServiceVIPs(serviceID string) ([]string, error) {
+	ctx := context.Background()
+	cli := instance.cli
+
+	service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := service.Spec.Labels[wakeOnVIPLabel]
+	if !ok {
+		return nil, nil
+	}
+	wake, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s label %q: %v", wakeOnVIPLabel, value, err)
+	}
+	if !wake {
+		return nil, nil
 	}
 
-	return publishedPort, nil
+	vips := make([]string, 0, len(service.Endpoint.VirtualIPs))
+	for _, vip := range service.Endpoint.VirtualIPs {
+		// Addresses are in CIDR notation, e.g. 10.0.1.5/24
+		addr, _, _ := strings.Cut(vip.Addr, "/")
+		if addr != "" {
+			vips = append(vips, addr)
+		}
+	}
+
+	return vips, nil
+}
+
+// GetServiceHosts returns the hostnames a reverse proxy routes to the
+// service by, from its labels. Only works on manager nodes.
+func GetServiceHosts(serviceID string) ([]string, error) {
+	labels, err := GetServiceLabels(serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	add := func(host string) {
+		host = strings.TrimSpace(host)
+		if host != "" && host != "*" && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if value, ok := labels[hostsLabel]; ok {
+		for _, host := range strings.Split(value, ",") {
+			add(host)
+		}
+		return hosts, nil
+	}
+
+	// e.g. traefik.http.routers.web.rule=Host(`example.com`) || Host(`www.example.com`)
+	for key, value := range labels {
+		if !strings.HasPrefix(key, "traefik.") || !strings.HasSuffix(key, ".rule") {
+			continue
+		}
+		for _, rule := range traefikHostRule.FindAllStringSubmatch(value, -1) {
+			for _, quoted := range quotedValue.FindAllStringSubmatch(rule[1], -1) {
+				add(quoted[1])
+			}
+		}
+	}
+
+	return hosts, nil
 }
 
 // keepAliveAndScaleDown handles the keep-alive logic and scales down the service after the keep-alive period
@@ -248,32 +498,12 @@ func keepAliveAndScaleDown(serviceID string, keepAliveCh chan bool) {
 	case <-time.After(instance.nodeInfo.KeepAlive):
 		if _, exists := instance.keepAliveOps[serviceID]; exists {
 			logging.AddEventLog(fmt.Sprintf("Completed KeepAlive operation for service %s", serviceID))
-			port, err := GetPublishedPort(serviceID)
-			if err != nil {
-				logging.AddEventLog(fmt.Sprintf("Error getting published port for service %s: %v", serviceID, err))
-				return
-			}
-
-			if err := instance.portListener.ListenOnPort(port, serviceID); err != nil {
-				logging.AddEventLog(fmt.Sprintf("Failed to listen on port for service %s: %v", serviceID, err))
-				return
-			}
-
-			err = server.SendListenRequestToAllNodes(instance.nodeInfo, port, serviceID)
-			if err != nil {
-				logging.AddEventLog(fmt.Sprintf("Error sending listen request to all nodes for service %s: %v", serviceID, err))
-				return
+			if err := armAndScaleDown(serviceID); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Not scaling service %s to 0: %v", serviceID, err))
 			}
 
-			err = scaleTo(serviceID, 0)
-			if err != nil {
-				logging.AddEventLog(fmt.Sprintf("Error scaling service %s to 0: %v", serviceID, err))
-				return
-			}
-			
 			// Remove the keep-alive operation from the map
 			delete(instance.keepAliveOps, serviceID)
-			
 		}
 	case <-keepAliveCh:
 		// Keep-alive operation was canceled
@@ -281,6 +511,105 @@ func keepAliveAndScaleDown(serviceID string, keepAliveCh chan bool) {
 	}
 }
 
+// armAndScaleDown arms all the ports, VIPs and hosts of a service, here and on
+// the other nodes, and scales it to 0. Either everything is armed and the
+// service scaled down, or whatever was armed is removed again, so a service
+// is never left at 0 replicas with only part of its traffic able to wake it.
+func armAndScaleDown(serviceID string) error {
+	// Services only reached over their networks or through a shared reverse
+	// proxy have no published ports, they are woken through their VIPs or
+	// hostnames
+	ports, err := GetPublishedPorts(serviceID)
+	if err != nil {
+		return fmt.Errorf("error getting published ports: %v", err)
+	}
+	vips, err := GetServiceVIPs(serviceID)
+	if err != nil {
+		return fmt.Errorf("error getting VIPs: %v", err)
+	}
+	hosts, err := GetServiceHosts(serviceID)
+	if err != nil {
+		return fmt.Errorf("error getting hosts: %v", err)
+	}
+	if len(ports)+len(vips)+len(hosts) == 0 {
+		return fmt.Errorf("no port, VIP or host to wake it")
+	}
+
+	var disarms []func()
+	disarm := func() {
+		for _, d := range disarms {
+			d()
+		}
+	}
+
+	for _, port := range ports {
+		port := port // captured by its disarm
+		if err := instance.portListener.ListenOnPort(port, serviceID); err != nil {
+			disarm()
+			return fmt.Errorf("failed to listen on port %s: %v", port, err)
+		}
+		disarms = append(disarms, func() {
+			if err := instance.portListener.RemovePort(port); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to remove port %s: %v", port, err))
+			}
+			if err := server.SendRemoveRequestToAllNodes(instance.nodeInfo, port); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to send remove request to all nodes: %v", err))
+			}
+		})
+
+		if err := server.SendListenRequestToAllNodes(instance.nodeInfo, port, serviceID); err != nil {
+			disarm()
+			return fmt.Errorf("error sending listen request to all nodes: %v", err)
+		}
+	}
+	for _, vip := range vips {
+		vip := vip // captured by its disarm
+		if err := instance.portListener.ListenOnVIP(vip, serviceID); err != nil {
+			disarm()
+			return fmt.Errorf("failed to listen on VIP %s: %v", vip, err)
+		}
+		disarms = append(disarms, func() {
+			if err := instance.portListener.RemoveVIP(vip); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to remove VIP %s: %v", vip, err))
+			}
+			if err := server.SendListenerRequestToAllNodes(instance.nodeInfo, server.ListenerRequest{Kind: server.VIPTarget, Target: vip}); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to send remove VIP request to all nodes: %v", err))
+			}
+		})
+
+		if err := server.SendListenerRequestToAllNodes(instance.nodeInfo, server.ListenerRequest{Kind: server.VIPTarget, Target: vip, ServiceID: serviceID}); err != nil {
+			disarm()
+			return fmt.Errorf("error sending listen VIP request to all nodes: %v", err)
+		}
+	}
+	for _, host := range hosts {
+		host := host // captured by its disarm
+		if err := instance.portListener.ListenOnHost(host, serviceID); err != nil {
+			disarm()
+			return fmt.Errorf("failed to listen on host %s: %v", host, err)
+		}
+		disarms = append(disarms, func() {
+			if err := instance.portListener.RemoveHost(host); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to remove host %s: %v", host, err))
+			}
+			if err := server.SendListenerRequestToAllNodes(instance.nodeInfo, server.ListenerRequest{Kind: server.HostTarget, Target: host}); err != nil {
+				logging.AddEventLog(fmt.Sprintf("Failed to send remove host request to all nodes: %v", err))
+			}
+		})
+
+		if err := server.SendListenerRequestToAllNodes(instance.nodeInfo, server.ListenerRequest{Kind: server.HostTarget, Target: host, ServiceID: serviceID}); err != nil {
+			disarm()
+			return fmt.Errorf("error sending listen host request to all nodes: %v", err)
+		}
+	}
+
+	if err := scaleTo(serviceID, 0); err != nil {
+		disarm()
+		return fmt.Errorf("error scaling to 0: %v", err)
+	}
+	return nil
+}
+
 // EventNotifier notifies about container start and stop events.
 type EventNotifier struct {
 	StartChan chan string
@@ -295,14 +624,18 @@ func (s *ScaleManager) NewEventNotifier() *EventNotifier {
 	}
 }
 
-// ListenForEvents starts listening for Docker container start and stop events.
+// ListenForEvents starts listening for Docker container start and stop events,
+// and for service updates that may change their scaling labels.
 func (en *EventNotifier) ListenForEvents(ctx context.Context) {
 	cli := instance.cli
 
 	filters := filters.NewArgs(
 		filters.Arg("type", "container"),
+		filters.Arg("type", "service"),
 		filters.Arg("event", "start"),
 		filters.Arg("event", "die"),
+		filters.Arg("event", "update"),
+		filters.Arg("event", "remove"),
 	)
 
 	options := types.EventsOptions{
@@ -315,6 +648,14 @@ func (en *EventNotifier) ListenForEvents(ctx context.Context) {
 	for {
 		select {
 		case event := <-eventsCh:
+			if event.Type == events.ServiceEventType {
+				if event.Action == "update" || event.Action == "remove" {
+					serviceLabelsCache.Delete(event.Actor.ID)
+					notifyServiceUpdate(event.Actor.ID)
+				}
+				continue
+			}
+
 			switch event.Action {
 			case "start":
 				owned, err := CheckOwnedContainer(event.ID)
@@ -328,6 +669,8 @@ func (en *EventNotifier) ListenForEvents(ctx context.Context) {
 					en.StartChan <- event.ID
 				}
 			case "die":
+				containerLabelsCache.Delete(event.ID)
+
 				owned, err := CheckOwnedContainer(event.ID)
 				if err != nil {
 					logging.AddEventLog(fmt.Sprintf("Error checking ownership of container %s: %v", event.ID, err))
@@ -407,28 +750,38 @@ func CheckOwnedContainer(containerID string) (bool, error) {
 	return false, nil
 }
 
-func GetContainerNamespace(containerID string) (uint32, error) {
-    cli, err := client.NewClientWithOpts(client.FromEnv)
-    if err != nil {
-        return 0, err
-    }
+// GetContainerPid returns the host PID of the container's init process.
+func GetContainerPid(containerID string) (int, error) {
+	cli := instance.cli
 
-    inspect, err := cli.ContainerInspect(context.Background(), containerID)
-    if err != nil {
-        return 0, err
-    }
+	inspect, err := cli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return 0, err
+	}
+
+	if inspect.State == nil || inspect.State.Pid == 0 {
+		return 0, fmt.Errorf("container %s has no running init process", containerID)
+	}
 
-	pid := inspect.State.Pid
-	var procPath string
+	return inspect.State.Pid, nil
+}
 
-    // Check if /host_proc exists
-    if _, err := os.Stat("/host_proc"); err == nil {
-        // Use /host_proc if it exists
-        procPath = fmt.Sprintf("/host_proc/%d/ns/net", pid)
-    } else {
-        // Fallback to /proc
-        procPath = fmt.Sprintf("/proc/%d/ns/net", pid)
-    }
+// ProcRoot returns the host procfs mount, preferring /host_proc when the
+// autoscaler runs inside a container.
+func ProcRoot() string {
+	if _, err := os.Stat("/host_proc"); err == nil {
+		return "/host_proc"
+	}
+	return "/proc"
+}
+
+func GetContainerNamespace(containerID string) (uint32, error) {
+	pid, err := GetContainerPid(containerID)
+	if err != nil {
+		return 0, err
+	}
+
+	procPath := fmt.Sprintf("%s/%d/ns/net", ProcRoot(), pid)
 
     // Check if the file exists
     if _, err := os.Stat(procPath); os.IsNotExist(err) {
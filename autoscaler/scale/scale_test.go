@@ -0,0 +1,237 @@
+package scale
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"server"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// fakeSwarm serves the service inspect and update calls of the Docker API
+// for a single service, and records the replicas it is scaled to
+type fakeSwarm struct {
+	service   swarm.Service
+	failScale bool
+	scaledTo  []uint64
+}
+
+func (f *fakeSwarm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// e.g. /v1.45/services/web or /v1.45/services/web/update
+	_, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && path == "services/"+f.service.ID:
+		json.NewEncoder(w).Encode(f.service)
+	case r.Method == http.MethodPost && path == "services/"+f.service.ID+"/update":
+		if f.failScale {
+			http.Error(w, `{"message": "update out of sequence"}`, http.StatusInternalServerError)
+			return
+		}
+		var spec swarm.ServiceSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.scaledTo = append(f.scaledTo, *spec.Mode.Replicated.Replicas)
+		json.NewEncoder(w).Encode(swarm.ServiceUpdateResponse{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeListener records what is listened on, failing for the targets in fail
+type fakeListener struct {
+	fail    map[string]bool
+	armed   []string
+	removed []string
+}
+
+func (l *fakeListener) listen(target string) error {
+	if l.fail[target] {
+		return errors.New("map full")
+	}
+	l.armed = append(l.armed, target)
+	return nil
+}
+
+func (l *fakeListener) ListenOnPort(port server.PublishedPort, serviceID string) error {
+	return l.listen(port.String())
+}
+
+func (l *fakeListener) ListenOnVIP(vip string, serviceID string) error {
+	return l.listen(vip)
+}
+
+func (l *fakeListener) ListenOnHost(host string, serviceID string) error {
+	return l.listen(host)
+}
+
+func (l *fakeListener) RemovePort(port server.PublishedPort) error {
+	l.removed = append(l.removed, port.String())
+	return nil
+}
+
+func (l *fakeListener) RemoveVIP(vip string) error {
+	l.removed = append(l.removed, vip)
+	return nil
+}
+
+func (l *fakeListener) RemoveHost(host string) error {
+	l.removed = append(l.removed, host)
+	return nil
+}
+
+// newTestScaler points the scaler at a fake swarm without other nodes, so
+// nothing is sent to them
+func newTestScaler(t *testing.T, swarmAPI *fakeSwarm, listener PortListener) {
+	t.Helper()
+
+	srv := httptest.NewServer(swarmAPI)
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+srv.Listener.Addr().String()),
+		client.WithHTTPClient(srv.Client()),
+		client.WithVersion("1.45"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	previous := instance
+	instance = &ScaleManager{cli: cli, portListener: listener, keepAliveOps: make(map[string]chan bool)}
+	t.Cleanup(func() { instance = previous })
+}
+
+func testService(labels map[string]string, ports []uint32, vips []string) swarm.Service {
+	replicas := uint64(2)
+	service := swarm.Service{ID: "web"}
+	service.Spec.Labels = labels
+	service.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+	for _, port := range ports {
+		service.Endpoint.Ports = append(service.Endpoint.Ports, swarm.PortConfig{PublishedPort: port, Protocol: swarm.PortConfigProtocolTCP})
+	}
+	for _, vip := range vips {
+		service.Endpoint.VirtualIPs = append(service.Endpoint.VirtualIPs, swarm.EndpointVirtualIP{Addr: vip + "/24"})
+	}
+	return service
+}
+
+func TestArmAndScaleDown(t *testing.T) {
+	tests := []struct {
+		name      string
+		service   swarm.Service
+		wantArmed []string
+		wantErr   bool
+	}{
+		{
+			name:      "published ports",
+			service:   testService(nil, []uint32{8080, 8443}, []string{"10.0.1.5"}),
+			wantArmed: []string{portString(8080), portString(8443)},
+		},
+		{
+			name:      "only a VIP",
+			service:   testService(map[string]string{wakeOnVIPLabel: "true"}, nil, []string{"10.0.1.5"}),
+			wantArmed: []string{"10.0.1.5"},
+		},
+		{
+			name:      "only a host",
+			service:   testService(map[string]string{hostsLabel: "web.example.com"}, nil, nil),
+			wantArmed: []string{"web.example.com"},
+		},
+		{
+			name:    "nothing to wake it",
+			service: testService(nil, nil, []string{"10.0.1.5"}),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swarmAPI := &fakeSwarm{service: tt.service}
+			listener := &fakeListener{}
+			newTestScaler(t, swarmAPI, listener)
+
+			err := armAndScaleDown("web")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("armAndScaleDown() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(listener.armed, tt.wantArmed) {
+				t.Errorf("armed %v, want %v", listener.armed, tt.wantArmed)
+			}
+			if len(listener.removed) != 0 {
+				t.Errorf("removed %v", listener.removed)
+			}
+
+			var wantScaledTo []uint64
+			if !tt.wantErr {
+				wantScaledTo = []uint64{0}
+			}
+			if !slices.Equal(swarmAPI.scaledTo, wantScaledTo) {
+				t.Errorf("scaled to %v, want %v", swarmAPI.scaledTo, wantScaledTo)
+			}
+		})
+	}
+}
+
+func TestArmAndScaleDownRollback(t *testing.T) {
+	labels := map[string]string{wakeOnVIPLabel: "true", hostsLabel: "a.example.com,b.example.com"}
+	service := testService(labels, []uint32{8080, 8081}, []string{"10.0.1.5", "10.0.2.5"})
+
+	tests := []struct {
+		name        string
+		fail        string
+		failScale   bool
+		wantRemoved []string
+	}{
+		{
+			name:        "second port",
+			fail:        portString(8081),
+			wantRemoved: []string{portString(8080)},
+		},
+		{
+			name:        "second VIP",
+			fail:        "10.0.2.5",
+			wantRemoved: []string{portString(8080), portString(8081), "10.0.1.5"},
+		},
+		{
+			name:        "second host",
+			fail:        "b.example.com",
+			wantRemoved: []string{portString(8080), portString(8081), "10.0.1.5", "10.0.2.5", "a.example.com"},
+		},
+		{
+			name:        "scaling",
+			failScale:   true,
+			wantRemoved: []string{portString(8080), portString(8081), "10.0.1.5", "10.0.2.5", "a.example.com", "b.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swarmAPI := &fakeSwarm{service: service, failScale: tt.failScale}
+			listener := &fakeListener{fail: map[string]bool{tt.fail: true}}
+			newTestScaler(t, swarmAPI, listener)
+
+			if err := armAndScaleDown("web"); err == nil {
+				t.Fatal("armAndScaleDown() succeeded")
+			}
+			if !slices.Equal(listener.removed, tt.wantRemoved) {
+				t.Errorf("removed %v, want %v", listener.removed, tt.wantRemoved)
+			}
+			if len(swarmAPI.scaledTo) != 0 {
+				t.Errorf("scaled to %v", swarmAPI.scaledTo)
+			}
+		})
+	}
+}
+
+func portString(port uint32) string {
+	return server.PublishedPort{Port: port, Protocol: "tcp"}.String()
+}
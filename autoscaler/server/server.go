@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"logging"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -89,21 +90,175 @@ func SendScaleRequest(serviceId string, direction string, managerIP string) erro
 
 }
 
+// ConcurrencySample is the live connection count of one replica, reported
+// to the manager by the node running it
+type ConcurrencySample struct {
+	ServiceID   string    `json:"serviceId"`
+	ContainerID string    `json:"containerId"`
+	Node        string    `json:"node"`
+	Connections uint32    `json:"connections"`
+	Buffer      uint32    `json:"buffer"`
+	Time        time.Time `json:"time"`
+}
+
+// ServiceConcurrency is the concurrency of a service across all its replicas
+type ServiceConcurrency struct {
+	ServiceID   string `json:"serviceId"`
+	Connections uint32 `json:"connections"`
+	Max         uint32 `json:"max"`
+	Replicas    int    `json:"replicas"`
+}
+
+// HandleMetrics adds the /metrics endpoint to the scaling server. Workers
+// POST their samples to it and GET returns the per-service totals.
+func HandleMetrics(recordFunc func(samples []ConcurrencySample), summaryFunc func() []ServiceConcurrency) {
+	http.HandleFunc("/metrics", createMetricsHandler(recordFunc, summaryFunc))
+}
+
+func createMetricsHandler(recordFunc func(samples []ConcurrencySample), summaryFunc func() []ServiceConcurrency) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(summaryFunc()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		case http.MethodPost:
+			var samples []ConcurrencySample
+			if err := json.NewDecoder(r.Body).Decode(&samples); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			recordFunc(samples)
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Metrics recorded."))
+		default:
+			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// send concurrency samples to manager node from worker node
+func SendMetrics(samples []ConcurrencySample, managerIP string) error {
+
+	jsonData, err := json.Marshal(samples)
+
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON data: %w", err)
+	}
+
+	resp, err := http.Post("http://"+managerIP+":4567/metrics", "application/json", bytes.NewBuffer(jsonData))
+
+	if err != nil {
+		return fmt.Errorf("error sending metrics to manager node: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("manager node returned %s for metrics", resp.Status)
+	}
+	return nil
+}
+
+// ReplicaStatus is the desired and running replica count of a service
+type ReplicaStatus struct {
+	Desired uint64 `json:"desired"`
+	Running uint64 `json:"running"`
+}
+
+// HandleReplicas adds the /replicas endpoint to the scaling server, so workers
+// can tell when a scaling request has taken effect
+func HandleReplicas(statusFunc func(serviceID string) (ReplicaStatus, error)) {
+	http.HandleFunc("/replicas", createReplicasHandler(statusFunc))
+}
+
+func createReplicasHandler(statusFunc func(serviceID string) (ReplicaStatus, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		serviceID := r.URL.Query().Get("serviceId")
+		if serviceID == "" {
+			http.Error(w, "serviceId is required", http.StatusBadRequest)
+			return
+		}
+
+		status, err := statusFunc(serviceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// get the replica status of a service from the manager node
+func SendReplicasRequest(serviceID string, managerIP string) (ReplicaStatus, error) {
+	var status ReplicaStatus
+
+	resp, err := http.Get("http://" + managerIP + ":4567/replicas?serviceId=" + url.QueryEscape(serviceID))
+	if err != nil {
+		return status, fmt.Errorf("error sending replicas request to manager node: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("manager node returned %s for replicas request", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("error decoding replicas response: %w", err)
+	}
+
+	return status, nil
+}
+
 // BPF Port Listener Server
 
-func PortServer(listenOnPortFunc func(port uint32, serviceID string) error, removePortFunc func(port uint32) error) {
+// PublishedPort is a port a service publishes through the routing mesh
+type PublishedPort struct {
+	Port     uint32 `json:"port"`
+	Protocol string `json:"protocol"` // tcp, udp or sctp, as reported by Docker
+}
+
+func (port PublishedPort) String() string {
+	return fmt.Sprintf("%d/%s", port.Port, port.Protocol)
+}
+
+// decodePublishedPort fills in the protocol for requests from nodes that only
+// send a port number, which was always TCP
+func decodePublishedPort(port *PublishedPort) {
+	if port.Protocol == "" {
+		port.Protocol = "tcp"
+	}
+}
+
+func PortServer(listenOnPortFunc func(port PublishedPort, serviceID string) error, removePortFunc func(port PublishedPort) error, listenOnVIPFunc func(vip string, serviceID string) error, removeVIPFunc func(vip string) error, listenOnHostFunc func(host string, serviceID string) error, removeHostFunc func(host string) error) {
 	listenHandler := ListenPortHandler(listenOnPortFunc)
 	removeHandler := RemovePortHandler(removePortFunc)
 
 	http.HandleFunc("/listen", listenHandler)
 	http.HandleFunc("/remove", removeHandler)
+	http.HandleFunc("/listen-vip", listenerHandler(VIPTarget, listenOnVIPFunc, "Listening on VIP."))
+	http.HandleFunc("/remove-vip", listenerHandler(VIPTarget, func(vip, _ string) error { return removeVIPFunc(vip) }, "Removed VIP."))
+	http.HandleFunc("/listen-host", listenerHandler(HostTarget, listenOnHostFunc, "Listening on host."))
+	http.HandleFunc("/remove-host", listenerHandler(HostTarget, func(host, _ string) error { return removeHostFunc(host) }, "Removed host."))
 	logging.AddEventLog("Starting HTTP server on port 4568")
 	if err := http.ListenAndServe(":4568", nil); err != nil {
 		fmt.Printf("HTTP server error: %v\n", err)
 	}
 }
 
-func ListenPortHandler(listenOnPortFunc func(port uint32, serviceID string) error) http.HandlerFunc {
+func ListenPortHandler(listenOnPortFunc func(port PublishedPort, serviceID string) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
@@ -111,16 +266,17 @@ func ListenPortHandler(listenOnPortFunc func(port uint32, serviceID string) erro
 		}
 
 		var data struct {
-			Port      uint32 `json:"port"`
+			PublishedPort
 			ServiceID string `json:"serviceId"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		decodePublishedPort(&data.PublishedPort)
 
 		// call the listenOnPortFunc
-		if err := listenOnPortFunc(data.Port, data.ServiceID); err != nil {
+		if err := listenOnPortFunc(data.PublishedPort, data.ServiceID); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -130,23 +286,22 @@ func ListenPortHandler(listenOnPortFunc func(port uint32, serviceID string) erro
 	}
 }
 
-func RemovePortHandler(removePortFunc func(port uint32) error) http.HandlerFunc {
+func RemovePortHandler(removePortFunc func(port PublishedPort) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var data struct {
-			Port uint32 `json:"port"`
-		}
+		var data PublishedPort
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		decodePublishedPort(&data)
 
 		// call the removePortFunc
-		if err := removePortFunc(data.Port); err != nil {
+		if err := removePortFunc(data); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -156,9 +311,92 @@ func RemovePortHandler(removePortFunc func(port uint32) error) http.HandlerFunc
 	}
 }
 
-func SendListenRequest(port uint32, serviceID string, ip string) error {
+// Kinds of ListenerRequest target, also the JSON field the target is sent in
+const (
+	VIPTarget  = "vip"
+	HostTarget = "host"
+)
+
+// ListenerRequest arms or removes a VIP or host on the port listener of a
+// node
+type ListenerRequest struct {
+	Kind      string // VIPTarget or HostTarget
+	Target    string
+	ServiceID string // empty to remove the target
+}
+
+func (req ListenerRequest) path() string {
+	if req.ServiceID == "" {
+		return "/remove-" + req.Kind
+	}
+	return "/listen-" + req.Kind
+}
+
+// listenerHandler serves the ListenerRequests of one kind and path. apply is
+// called with the target and, when listening, the service ID.
+func listenerHandler(kind string, apply func(target string, serviceID string) error, done string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var data map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := apply(data[kind], data["serviceId"]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(done))
+	}
+}
+
+// sendListenerRequest posts a VIP or host request to the port listener
+// server of a node
+func sendListenerRequest(req ListenerRequest, ip string) error {
+	data := map[string]string{req.Kind: req.Target}
+	if req.ServiceID != "" {
+		data["serviceId"] = req.ServiceID
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON data: %w", err)
+	}
 
-	data := map[string]interface{}{"port": port, "serviceId": serviceID}
+	path := req.path()
+	resp, err := http.Post("http://"+ip+":4568"+path, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("error sending %s request to node %s: %w", path, ip, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s request to node %s failed with status %s", path, ip, resp.Status)
+	}
+	return nil
+}
+
+// SendListenerRequestToAllNodes sends a VIP or host request to every other
+// node, stopping at the first that fails
+func SendListenerRequestToAllNodes(swarmNodeInfo SwarmNodeInfo, req ListenerRequest) error {
+	for _, node := range swarmNodeInfo.OtherNodes {
+		if err := sendListenerRequest(req, node.IP); err != nil {
+			logging.AddEventLog(fmt.Sprintf("Failed to send %s request to node %s: %v", req.path(), node.IP, err))
+			return err
+		}
+	}
+	return nil
+}
+
+func SendListenRequest(port PublishedPort, serviceID string, ip string) error {
+
+	data := map[string]interface{}{"port": port.Port, "protocol": port.Protocol, "serviceId": serviceID}
 	jsonData, err := json.Marshal(data)
 
 	if err != nil {
@@ -177,10 +415,9 @@ func SendListenRequest(port uint32, serviceID string, ip string) error {
 
 }
 
-func SendRemoveRequest(port uint32, ip string) error {
+func SendRemoveRequest(port PublishedPort, ip string) error {
 
-	data := map[string]uint32{"port": port}
-	jsonData, err := json.Marshal(data)
+	jsonData, err := json.Marshal(port)
 
 	if err != nil {
 		return fmt.Errorf("error marshalling JSON data: %w", err)
@@ -197,7 +434,7 @@ func SendRemoveRequest(port uint32, ip string) error {
 	return nil
 }
 
-func SendListenRequestToAllNodes(swarmNodeInfo SwarmNodeInfo, port uint32, serviceID string) error {
+func SendListenRequestToAllNodes(swarmNodeInfo SwarmNodeInfo, port PublishedPort, serviceID string) error {
 	for _, node := range swarmNodeInfo.OtherNodes {
 
 		err := SendListenRequest(port, serviceID, node.IP)
@@ -210,7 +447,7 @@ func SendListenRequestToAllNodes(swarmNodeInfo SwarmNodeInfo, port uint32, servi
 	return nil
 }
 
-func SendRemoveRequestToAllNodes(swarmNodeInfo SwarmNodeInfo, port uint32) error {
+func SendRemoveRequestToAllNodes(swarmNodeInfo SwarmNodeInfo, port PublishedPort) error {
 	for _, node := range swarmNodeInfo.OtherNodes {
 
 		err := SendRemoveRequest(port, node.IP)